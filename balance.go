@@ -0,0 +1,81 @@
+package gosms
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BalanceCheck запрос баланса SIM одного устройства через USSD
+type BalanceCheck struct {
+	Code     string // например *100#
+	Interval time.Duration
+	// Low порог, ниже которого вызывается OnLowBalance, 0 - только при отрицательном балансе
+	Low float64
+	// Pattern выделяет сумму из ответа первой группой, nil - число после слова "баланс"
+	// или первое число в ответе
+	Pattern *regexp.Regexp
+}
+
+func (c BalanceCheck) interval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return BalanceInterval
+}
+
+// BalanceChecks запросы баланса по идентификатору устройства (DEVID)
+var BalanceChecks = map[string]BalanceCheck{}
+
+// BalanceInterval как часто запрашивать баланс, если Interval не задан
+var BalanceInterval = 6 * time.Hour
+
+// OnLowBalance вызывается один раз, когда баланс устройства опускается ниже порога,
+// следующий раз - после того, как баланс поднимется выше порога и снова упадет
+var OnLowBalance func(device string, balance float64, response string)
+
+// Balance последний известный баланс устройства для /api/devices/
+type Balance struct {
+	// Amount nil, если сумму не удалось выделить из ответа
+	Amount    *float64 `json:"amount"`
+	Response  string   `json:"response"`
+	CheckedAt string   `json:"checked_at"`
+	Low       bool     `json:"low"`
+	// Error ошибка последнего запроса, Amount и Response остаются от последнего удачного
+	Error string `json:"error"`
+}
+
+var balanceNear = regexp.MustCompile(`(?i)(?:баланс|balance|остаток)[^\d-]*?(минус\s*|-)?(\d+(?:[.,]\d+)?)`)
+var balanceFirst = regexp.MustCompile(`(?i)(минус\s*|-)?(\d+(?:[.,]\d+)?)`)
+
+// ParseBalance сумма из ответа оператора, например "Баланс: -12,30 р." или "Balance 100.00 RUB"
+func ParseBalance(response string, pattern *regexp.Regexp) (float64, error) {
+	var number string
+	if pattern != nil {
+		match := pattern.FindStringSubmatch(response)
+		if len(match) < 2 {
+			return 0, fmt.Errorf("no balance in %q", response)
+		}
+		number = match[1]
+	} else {
+		match := balanceNear.FindStringSubmatch(response)
+		if match == nil {
+			match = balanceFirst.FindStringSubmatch(response)
+		}
+		if match == nil {
+			return 0, fmt.Errorf("no balance in %q", response)
+		}
+		number = match[2]
+		if match[1] != "" {
+			number = "-" + number
+		}
+	}
+	number = strings.Replace(strings.Replace(number, " ", "", -1), ",", ".", 1)
+	balance, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("no balance in %q", response)
+	}
+	return balance, nil
+}
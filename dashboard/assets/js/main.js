@@ -1,5 +1,7 @@
 $(function() {
-  var SMSStatus = ["Pending", "Processed", "Error"]
+  var SMSStatus = ["Pending", "Processed", "Error", "Delivered", "Expired", "Rejected", "Cancelled", "Dead letter", "Unknown"]
+  var SMSDeadLetter = 7
+  var SMSUnknown = 8
 
   // SMS Log Table
   var logTable = $('#smsdata').dataTable({
@@ -9,13 +11,25 @@ $(function() {
     "oLanguage": { "sSearch": "" },
     "columns": [
         { "data": "user.phone_number" },
+        { "data": "channel" },
         { "data": "body" },
         { "data": "status",
           "mRender": function( data, type, full ) {
+            if (type === "display" && (data === SMSDeadLetter || data === SMSUnknown)) {
+              return SMSStatus[data] + ' <a href="#" class="retry-sms btn btn-xs btn-default" data-uuid="' +
+                full.uuid + '">retry</a>';
+            }
             return SMSStatus[data];
           },
           bUseRendered: false
         },
+        { "data": "error" },
+        { "data": "send_at",
+          "mRender": function( data, type, full ) {
+            return data ? data + (full.marketing ? " (marketing)" : "") : "";
+          },
+          bUseRendered: false
+        },
         { "data": "created_at" },
         { "data": "updated_at" }
     ]
@@ -81,6 +95,57 @@ $(function() {
     })
   }
 
+  var loadDevices = function() {
+    $.ajax({
+      url: "/api/devices/"
+    })
+    .done(function(resp) {
+      var rows = $("#devices tbody").empty();
+      var signal = [];
+      $.each(resp.devices || [], function(i, device) {
+        var info = device.info || {};
+        var state = device.healthy ? "ok" : "down: " + device.reason;
+        var dbm = info.signal && info.signal.dbm ? info.signal.dbm + " dBm" : "";
+        var battery = info.battery_level != null ? info.battery_level + "%" : "";
+        if (info.temperature != null) {
+          battery += " " + info.temperature + "\u00b0C";
+        }
+        var ids = [info.imei, info.imsi, info.iccid].filter(Boolean).join(" / ");
+        var balance = device.balance || {};
+        var amount = balance.amount != null ? balance.amount.toFixed(2) : (balance.response || "");
+        var row = $("<tr>");
+        $.each([device.id + " (" + device.channel + ")", info.manufacturer, state, dbm, info.operator, info.registration,
+                info.number, ids, battery, amount, device.sent, device.failed], function(j, value) {
+          $("<td>").text(value == null ? "" : String(value)).appendTo(row);
+        });
+        row.children().eq(9).attr("title", balance.error || balance.response || "");
+        row.toggleClass("danger", !device.healthy)
+           .toggleClass("warning", device.healthy && !!balance.low)
+           .appendTo(rows);
+
+        if (info.signal_history) {
+          signal.push({
+            label: device.id,
+            data: $.map(info.signal_history, function(sample) {
+              return [[ moment(sample.at).valueOf(), sample.dbm || null ]];
+            })
+          });
+        }
+      });
+      if (signal.length) {
+        $.plot("#signalChart", signal, {
+          series: { lines: { show: true }, points: { show: true, radius: 2 } },
+          xaxis: {
+            tickFormatter: function(value) { return moment(value).format("HH:mm"); }
+          },
+          yaxis: {
+            tickFormatter: function(value) { return value + " dBm"; }
+          }
+        });
+      }
+    });
+  }
+
   // Function to format pie chart labels
   function labelFormatter(label, series) {
     return "<div style='font-size:8pt; text-align:center; padding:2px; color: #333;'>" + Math.round(series.data[0][1]) + "</div>";
@@ -91,12 +156,31 @@ $(function() {
     var url = $(this).attr('action');
     var formData = $(this).serialize();
     $.post(url, formData, function(resp) {
-      // reload logs table					
+      // reload logs table
       loadData();
     });
     return false;
   });
-  
+
+  // Show encoding and number of parts while typing
+  $("#testSMS textarea[name=message]").on("input", function() {
+    $.post("/api/sms/estimate/", { message: $(this).val() }, function(resp) {
+      $("#smsEstimate").text(resp.encoding.toUpperCase() + ", " + resp.segments +
+        " SMS, " + resp.remaining + " characters left");
+    });
+  });
+
+  setInterval(loadDevices, 60000);
+
+  // Requeue a dead-lettered message
+  $("#smsdata").on("click", ".retry-sms", function() {
+    $.post("/api/sms/" + $(this).data("uuid") + "/retry", function(resp) {
+      loadData();
+    });
+    return false;
+  });
+
   loadData();
+  loadDevices();
 
-});
\ No newline at end of file
+});
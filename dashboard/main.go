@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"gosms"
 	"gosms/modem"
+	"gosms/transport"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -36,16 +43,112 @@ func main() {
 	numDevices, _ := strconv.Atoi(_numDevices)
 	log.Println("main: number of devices: ", numDevices)
 
-	var modems []*modem.GSMModem
+	var modems []transport.Transport
 	for i := 0; i < numDevices; i++ {
 		dev := fmt.Sprintf("DEVICE%v", i)
 		_port, _ := appConfig.Get(dev, "COMPORT")
 		_baud := 115200 //appConfig.Get(dev, "BAUDRATE")
 		_devid, _ := appConfig.Get(dev, "DEVID")
 		m := modem.New(_port, _baud, _devid)
+		_concatRef, _ := appConfig.Get(dev, "CONCATREF")
+		m.ConcatRef16 = _concatRef == "16"
+		_statusReport, _ := appConfig.Get(dev, "STATUSREPORT")
+		m.StatusReport = _statusReport == "1"
+		m.PIN, _ = appConfig.Get(dev, "PIN")
+		m.SMSC, _ = appConfig.Get(dev, "SMSC")
+		m.Storage, _ = appConfig.Get(dev, "STORAGE")
+		if _vendor, ok := appConfig.Get(dev, "VENDOR"); ok {
+			vendor, known := modem.ParseVendor(_vendor)
+			if !known {
+				log.Println("main: ", "Invalid VENDOR for ", _devid, ": ", _vendor, " Aborting")
+				os.Exit(1)
+			}
+			m.Vendor = vendor
+		}
+		// INITCOMMAND0, INITCOMMAND1... up to the first missing one
+		for j := 0; ; j++ {
+			command, ok := appConfig.Get(dev, fmt.Sprintf("INITCOMMAND%v", j))
+			if !ok {
+				break
+			}
+			m.InitCommands = append(m.InitCommands, command)
+		}
+
+		var limit gosms.RateLimit
+		limitKeys := map[string]*int{
+			"RATEMINUTE":   &limit.PerMinute,
+			"RATEHOUR":     &limit.PerHour,
+			"RATEDAY":      &limit.PerDay,
+			"MONTHLYQUOTA": &limit.MonthlyQuota,
+		}
+		for key, value := range limitKeys {
+			if _value, ok := appConfig.Get(dev, key); ok {
+				*value, _ = strconv.Atoi(_value)
+			}
+		}
+		gosms.RateLimits[_devid] = limit
+
+		if _balanceCode, ok := appConfig.Get(dev, "BALANCECODE"); ok {
+			check := gosms.BalanceCheck{Code: _balanceCode}
+			if _balanceInterval, ok := appConfig.Get(dev, "BALANCEINTERVAL"); ok {
+				balanceInterval, _ := strconv.Atoi(_balanceInterval)
+				check.Interval = time.Duration(balanceInterval) * time.Minute
+			}
+			if _balanceLow, ok := appConfig.Get(dev, "BALANCELOW"); ok {
+				check.Low, _ = strconv.ParseFloat(_balanceLow, 64)
+			}
+			if _balancePattern, ok := appConfig.Get(dev, "BALANCEPATTERN"); ok {
+				check.Pattern, err = regexp.Compile(_balancePattern)
+				if err != nil || check.Pattern.NumSubexp() < 1 {
+					log.Println("main: ", "Invalid BALANCEPATTERN for ", _devid, ", a regular expression with a group is expected", " Aborting")
+					os.Exit(1)
+				}
+			}
+			gosms.BalanceChecks[_devid] = check
+		}
 		modems = append(modems, m)
 	}
 
+	_retries, _ := appConfig.Get("SETTINGS", "RETRIES")
+	if retries, err := strconv.Atoi(_retries); err == nil && retries > 0 {
+		gosms.SMSRetryLimit = retries
+	}
+	if _retryDelay, ok := appConfig.Get("SETTINGS", "RETRYDELAY"); ok {
+		retryDelay, _ := strconv.Atoi(_retryDelay)
+		gosms.RetryDelay = time.Duration(retryDelay) * time.Second
+	}
+	if _retryMaxDelay, ok := appConfig.Get("SETTINGS", "RETRYMAXDELAY"); ok {
+		retryMaxDelay, _ := strconv.Atoi(_retryMaxDelay)
+		gosms.RetryMaxDelay = time.Duration(retryMaxDelay) * time.Second
+	}
+
+	timeouts := map[string]*time.Duration{
+		"COMMANDTIMEOUT": &modem.CommandTimeout,
+		"SUBMITTIMEOUT":  &modem.SubmitTimeout,
+		"SENDTIMEOUT":    &gosms.SendTimeout,
+		"LEASETIMEOUT":   &gosms.LeaseTimeout,
+	}
+	for key, value := range timeouts {
+		if _timeout, ok := appConfig.Get("SETTINGS", key); ok {
+			if timeout, _ := strconv.Atoi(_timeout); timeout > 0 {
+				*value = time.Duration(timeout) * time.Second
+			}
+		}
+	}
+
+	// optional, defaults to host name and pid
+	if instanceID, ok := appConfig.Get("SETTINGS", "INSTANCEID"); ok {
+		gosms.InstanceID = instanceID
+	}
+
+	// optional, defaults to 30 seconds
+	shutdownTimeout := 30 * time.Second
+	if _shutdownTimeout, ok := appConfig.Get("SETTINGS", "SHUTDOWNTIMEOUT"); ok {
+		if timeout, _ := strconv.Atoi(_shutdownTimeout); timeout > 0 {
+			shutdownTimeout = time.Duration(timeout) * time.Second
+		}
+	}
+
 	_bufferSize, _ := appConfig.Get("SETTINGS", "BUFFERSIZE")
 	bufferSize, _ := strconv.Atoi(_bufferSize)
 
@@ -61,16 +164,98 @@ func main() {
 	_loaderTimeoutLong, _ := appConfig.Get("SETTINGS", "MSGTIMEOUTLONG")
 	loaderTimeoutLong, _ := strconv.Atoi(_loaderTimeoutLong)
 
+	// optional, defaults to a minute
+	receiveTimeout := 60
+	if _receiveTimeout, ok := appConfig.Get("SETTINGS", "RECEIVEINTERVAL"); ok {
+		receiveTimeout, _ = strconv.Atoi(_receiveTimeout)
+	}
+
 	log.Println("main: Initializing tgbot")
 	initTgBot()
 
+	log.Println("main: Initializing whatsbot")
+	initWhatsBot()
+
+	if defaultRoute, ok := appConfig.Get("SETTINGS", "DEFAULTROUTE"); ok {
+		if _, err := gosms.ParseRoute(defaultRoute); err != nil {
+			log.Println("main: ", "Invalid DEFAULTROUTE: ", err.Error(), " Aborting")
+			os.Exit(1)
+		}
+		gosms.DefaultRoute = defaultRoute
+	}
+
+	if _probeInterval, ok := appConfig.Get("SETTINGS", "PROBEINTERVAL"); ok {
+		if probeInterval, _ := strconv.Atoi(_probeInterval); probeInterval > 0 {
+			gosms.ProbeInterval = time.Duration(probeInterval) * time.Second
+		}
+	}
+
+	if alertMobile, ok := appConfig.Get("SETTINGS", "ALERTMOBILE"); ok {
+		gosms.OnLowBalance = lowBalanceAlert(numberToStandard(alertMobile))
+	}
+
+	if quietHours, ok := appConfig.Get("SETTINGS", "QUIETHOURS"); ok {
+		gosms.Quiet, err = gosms.ParseQuietHours(quietHours)
+		if err != nil {
+			log.Println("main: ", "Invalid QUIETHOURS: ", err.Error(), " Aborting")
+			os.Exit(1)
+		}
+	}
+
+	if timezone, ok := appConfig.Get("SETTINGS", "TIMEZONE"); ok {
+		gosms.DefaultTimezone, err = time.LoadLocation(timezone)
+		if err != nil {
+			log.Println("main: ", "Invalid TIMEZONE: ", err.Error(), " Aborting")
+			os.Exit(1)
+		}
+	}
+
+	transports := map[string][]transport.Transport{
+		gosms.ChannelSMS:      modems,
+		gosms.ChannelTelegram: {Telegram},
+		gosms.ChannelWhatsApp: {WhatsApp},
+	}
+
 	log.Println("main: Initializing worker")
-	gosms.InitWorker(modems, bufferSize, bufferLow, loaderTimeout, loaderCountout, loaderTimeoutLong)
+	gosms.InitWorker(transports, bufferSize, bufferLow, loaderTimeout, loaderCountout, loaderTimeoutLong, receiveTimeout)
+
+	stopped := make(chan struct{})
+	go shutdownOnSignal(shutdownTimeout, stopped)
 
 	log.Println("main: Initializing server")
 	err = InitServer(serverhost, serverport, serverusername, serverpassword)
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		log.Println("main: ", "Error starting server: ", err.Error(), " Aborting")
 		os.Exit(1)
 	}
+	<-stopped
+	log.Println("main: ", "stopped")
+}
+
+// shutdownOnSignal по SIGINT или SIGTERM перестает принимать запросы API и сообщения бота,
+// дает устройствам закончить текущую отправку и закрывает порты за время grace.
+// База закрывается уже в main. Повторный сигнал завершает процесс сразу
+func shutdownOnSignal(grace time.Duration, stopped chan<- struct{}) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	log.Println("shutdownOnSignal: ", sig, ", stopping within ", grace)
+	go func() {
+		<-signals
+		log.Println("shutdownOnSignal: ", "second signal, exiting at once")
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Println("shutdownOnSignal: ", "server: ", err)
+	}
+	if Bot != nil {
+		Bot.Stop()
+	}
+	if err := gosms.StopWorker(ctx); err != nil {
+		log.Println("shutdownOnSignal: ", "worker: ", err)
+	}
+	close(stopped)
 }
@@ -1,18 +1,21 @@
 package main
 
 import (
-	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/satori/go.uuid"
 	"gosms"
+	"gosms/modem"
 	"html/template"
 	"log"
 	"net/http"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 )
 
 //reposne structure to /sms
@@ -21,13 +24,89 @@ type SMSResponse struct {
 	Message string `json:"message"`
 }
 
+//response structure to /sms/estimate/
+type SMSEstimateResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	modem.MessageInfo
+}
+
 //response structure to /smsdata/
 type SMSDataResponse struct {
-	Status   int            `json:"status"`
-	Message  string         `json:"message"`
-	Summary  []int          `json:"summary"`
-	DayCount map[string]int `json:"daycount"`
-	Messages []gosms.SMS    `json:"messages"`
+	Status   int              `json:"status"`
+	Message  string           `json:"message"`
+	Summary  []int            `json:"summary"`
+	Channels map[string][]int `json:"channels"`
+	DayCount map[string]int   `json:"daycount"`
+	Messages []gosms.SMS      `json:"messages"`
+}
+
+//response structure to /inbox/
+type InboxResponse struct {
+	Status   int                `json:"status"`
+	Message  string             `json:"message"`
+	Messages []gosms.InboundSMS `json:"messages"`
+}
+
+//response structure to /sms/{uuid}
+type SMSItemResponse struct {
+	Status  int        `json:"status"`
+	Message string     `json:"message"`
+	SMS     *gosms.SMS `json:"sms"`
+}
+
+//response structure to /deadletter/
+type DeadLetterResponse struct {
+	Status   int         `json:"status"`
+	Message  string      `json:"message"`
+	Messages []gosms.SMS `json:"messages"`
+}
+
+//response structure to /devices/
+type DevicesResponse struct {
+	Status  int                  `json:"status"`
+	Message string               `json:"message"`
+	Devices []gosms.DeviceStatus `json:"devices"`
+}
+
+//request structure to /batch/
+type BatchRequest struct {
+	Recipients []string `json:"recipients"`
+	Group      string   `json:"group"`
+	Message    string   `json:"message"`
+	Route      string   `json:"route"`
+	SendAt     string   `json:"send_at"`
+	Marketing  bool     `json:"marketing"`
+	Priority   string   `json:"priority"`
+}
+
+//per recipient result in /batch/ response
+type BatchRecipientResult struct {
+	Mobile string `json:"mobile"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+//response structure to /batch/
+type BatchResponse struct {
+	Status     int                    `json:"status"`
+	Message    string                 `json:"message"`
+	BatchID    string                 `json:"batch_id"`
+	Recipients []BatchRecipientResult `json:"recipients"`
+}
+
+//response structure to /batch/{id}/
+type BatchStatusResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	BatchID string `json:"batch_id"`
+	Total   int    `json:"total"`
+	Summary []int  `json:"summary"`
+}
+
+//request structure to /groups/{name}/
+type GroupRequest struct {
+	Recipients []string `json:"recipients"`
 }
 
 // Cache templates
@@ -65,30 +144,170 @@ func sendSMSHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("--- sendSMSHandler")
 	w.Header().Set("Content-type", "application/json")
 
-	//TODO: validation
 	r.ParseForm()
-	mobile := r.FormValue("mobile")
 	message := r.FormValue("message")
-	uuid, _ := uuid.NewV1()
+	if message == "" {
+		writeJSON(w, SMSResponse{Status: 400, Message: "message is empty"})
+		return
+	}
+	mobile, err := validateMobile(r.FormValue("mobile"))
+	if err != nil {
+		writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+		return
+	}
+
+	user, err := getUserOrMakeNew(mobile)
+	if err != nil {
+		log.Println("sendSMSHandler: ", err)
+		writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+		return
+	}
 
-	mobile = numberToStandard(mobile)
+	route, err := userRoute(r.FormValue("route"), user)
+	if err != nil {
+		writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+		return
+	}
+	sendAt, err := gosms.ParseSendAt(r.FormValue("send_at"))
+	if err != nil {
+		writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+		return
+	}
+	marketing := r.FormValue("marketing") == "1" || r.FormValue("marketing") == "true"
+	priority, err := gosms.ParsePriority(r.FormValue("priority"))
+	if err != nil {
+		writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+		return
+	}
+	enqueueRouted(user, message, route, "", sendAt, marketing, priority)
+
+	writeJSON(w, SMSResponse{Status: 200, Message: "ok"})
+}
 
-	sendMessageToTg(mobile, message)
+// userRoute политика запроса, иначе сохраненная для пользователя, иначе DEFAULTROUTE
+func userRoute(routeParam string, user *gosms.User) (gosms.Route, error) {
+	if routeParam == "" {
+		routeParam = user.Route
+	}
+	if routeParam == "" {
+		routeParam = gosms.DefaultRoute
+	}
+	return gosms.ParseRoute(routeParam)
+}
 
-	sendMessageToWhatsUp(mobile, message)
+// enqueueRouted ставит в очередь по сообщению на каждую ветку политики,
+// sendAt в формате базы или пусто для немедленной отправки
+func enqueueRouted(user *gosms.User, message string, route gosms.Route, batchID string, sendAt string, marketing bool, priority int) {
+	for _, leg := range route.Legs() {
+		uuid, _ := uuid.NewV1()
+		sms := &gosms.SMS{
+			UUID:      uuid.String(),
+			Body:      message,
+			Retries:   0,
+			User:      user,
+			Route:     leg.String(),
+			Channel:   leg.Steps[0].Channel,
+			BatchID:   batchID,
+			SendAt:    sendAt,
+			Marketing: marketing,
+			Priority:  priority,
+		}
+		gosms.EnqueueMessage(sms, true)
+	}
+}
 
-	user, err := getUserOrMakeNew(mobile)
+// lowBalanceAlert отправляет предупреждение о низком балансе SIM на номер из ALERTMOBILE
+func lowBalanceAlert(mobile string) func(device string, balance float64, response string) {
+	return func(device string, balance float64, response string) {
+		user, err := getUserOrMakeNew(mobile)
+		if err != nil {
+			log.Println("lowBalanceAlert: ", err)
+			return
+		}
+		route, err := userRoute("", user)
+		if err != nil {
+			log.Println("lowBalanceAlert: ", err)
+			return
+		}
+		message := fmt.Sprintf("gosms: low balance on %s: %.2f (%s)", device, balance, response)
+		enqueueRouted(user, message, route, "", "", false, gosms.PriorityTransactional)
+	}
+}
+
+// saves default delivery route for a mobile number, allowed methods: POST
+func setUserRouteHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- setUserRouteHandler")
+	w.Header().Set("Content-type", "application/json")
+
+	r.ParseForm()
+	mobile, err := validateMobile(r.FormValue("mobile"))
 	if err != nil {
-		log.Println(err)
+		writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
 		return
 	}
+	routeParam := r.FormValue("route")
 
-	sms := &gosms.SMS{UUID: uuid.String(), Body: message, Retries: 0, User: user}
-	gosms.EnqueueMessage(sms, true)
+	// empty route resets the number to DEFAULTROUTE
+	if routeParam != "" {
+		route, err := gosms.ParseRoute(routeParam)
+		if err != nil {
+			writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+			return
+		}
+		routeParam = route.String()
+	}
 
-	smsresp := SMSResponse{Status: 200, Message: "ok"}
-	var toWrite []byte
-	toWrite, err = json.Marshal(smsresp)
+	if _, err := getUserOrMakeNew(mobile); err != nil {
+		log.Println("setUserRouteHandler: ", err)
+		writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+		return
+	}
+	if err := gosms.UpdateRouteByPhoneNumber(mobile, routeParam); err != nil {
+		log.Println("setUserRouteHandler: ", err)
+		writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+		return
+	}
+
+	writeJSON(w, SMSResponse{Status: 200, Message: "ok"})
+}
+
+// saves time zone used for quiet hours of a mobile number, allowed methods: POST
+func setUserTimezoneHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- setUserTimezoneHandler")
+	w.Header().Set("Content-type", "application/json")
+
+	r.ParseForm()
+	mobile, err := validateMobile(r.FormValue("mobile"))
+	if err != nil {
+		writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+		return
+	}
+	timezone := r.FormValue("timezone")
+
+	// empty time zone resets the number to TIMEZONE
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+			return
+		}
+	}
+
+	if _, err := getUserOrMakeNew(mobile); err != nil {
+		log.Println("setUserTimezoneHandler: ", err)
+		writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+		return
+	}
+	if err := gosms.UpdateTimezoneByPhoneNumber(mobile, timezone); err != nil {
+		log.Println("setUserTimezoneHandler: ", err)
+		writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+		return
+	}
+
+	writeJSON(w, SMSResponse{Status: 200, Message: "ok"})
+}
+
+func writeJSON(w http.ResponseWriter, resp interface{}) {
+	toWrite, err := json.Marshal(resp)
 	if err != nil {
 		log.Println(err)
 		//lets just depend on the server to raise 500
@@ -114,6 +333,17 @@ func numberToStandard(phoneNumber string) string {
 	return phoneNumber
 }
 
+var mobileFormat = regexp.MustCompile(`^\+\d{10,15}$`)
+
+// validateMobile приводит номер к виду +71112223344 и проверяет его
+func validateMobile(mobile string) (string, error) {
+	mobile = numberToStandard(strings.TrimSpace(mobile))
+	if !mobileFormat.MatchString(mobile) {
+		return mobile, fmt.Errorf("invalid mobile number %q", mobile)
+	}
+	return mobile, nil
+}
+
 // getUserOrMakeNew получаем или создаем пользователя
 func getUserOrMakeNew(phoneNumber string) (*gosms.User, error) {
 	user, err := gosms.GetUserByPhoneNumber(phoneNumber)
@@ -137,43 +367,299 @@ func getUserOrMakeNew(phoneNumber string) (*gosms.User, error) {
 
 }
 
-func sendMessageToTg(phoneNumber string, message string) {
-	users, err := gosms.GetUsersByPhoneNumber(phoneNumber)
+// sends one message to many recipients or a named group, allowed methods: POST
+func sendBatchHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- sendBatchHandler")
+	w.Header().Set("Content-type", "application/json")
+
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+		return
+	}
+	if req.Message == "" {
+		writeJSON(w, SMSResponse{Status: 400, Message: "message is empty"})
+		return
+	}
+
+	sendAt, err := gosms.ParseSendAt(req.SendAt)
+	if err != nil {
+		writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+		return
+	}
+	// batches must not hold up one-time passwords unless asked to
+	priority := gosms.PriorityBulk
+	if req.Priority != "" {
+		if priority, err = gosms.ParsePriority(req.Priority); err != nil {
+			writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+			return
+		}
+	}
+
+	var route gosms.Route
+	if req.Route != "" {
+		if route, err = gosms.ParseRoute(req.Route); err != nil {
+			writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+			return
+		}
+	}
+
+	recipients := req.Recipients
+	if req.Group != "" {
+		members, err := gosms.GetGroupMembers(req.Group)
+		if err != nil {
+			writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+			return
+		}
+		for _, member := range members {
+			recipients = append(recipients, member.PhoneNumber)
+		}
+	}
+	if len(recipients) == 0 {
+		writeJSON(w, SMSResponse{Status: 400, Message: "no recipients"})
+		return
+	}
+
+	batchID, _ := uuid.NewV1()
+	resp := BatchResponse{Status: 200, Message: "ok", BatchID: batchID.String()}
+	seen := make(map[string]bool)
+	for _, recipient := range recipients {
+		mobile, err := validateMobile(recipient)
+		result := BatchRecipientResult{Mobile: mobile, Status: "queued"}
+		if err == nil && seen[mobile] {
+			err = errors.New("duplicate recipient")
+		}
+		var user *gosms.User
+		if err == nil {
+			user, err = getUserOrMakeNew(mobile)
+		}
+		recipientRoute := route
+		if err == nil && req.Route == "" {
+			recipientRoute, err = userRoute("", user)
+		}
+		if err != nil {
+			result.Status = "invalid"
+			result.Error = err.Error()
+			resp.Recipients = append(resp.Recipients, result)
+			continue
+		}
+		seen[mobile] = true
+		enqueueRouted(user, req.Message, recipientRoute, resp.BatchID, sendAt, req.Marketing, priority)
+		resp.Recipients = append(resp.Recipients, result)
+	}
+
+	writeJSON(w, resp)
+}
+
+// summarises progress of a batch, allowed methods: GET
+func getBatchHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- getBatchHandler")
+	w.Header().Set("Content-type", "application/json")
+
+	batchID := mux.Vars(r)["id"]
+	summary, err := gosms.GetBatchSummary(batchID)
+	if err != nil {
+		writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+		return
+	}
+	total := 0
+	for _, count := range summary {
+		total += count
+	}
+	if total == 0 {
+		writeJSON(w, SMSResponse{Status: 404, Message: "batch not found"})
+		return
+	}
+
+	writeJSON(w, BatchStatusResponse{Status: 200, Message: "ok", BatchID: batchID, Total: total, Summary: summary})
+}
+
+// replaces members of a named group of recipients, allowed methods: POST
+func setGroupHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- setGroupHandler")
+	w.Header().Set("Content-type", "application/json")
+
+	var req GroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+		return
+	}
+
+	var users []*gosms.User
+	for _, recipient := range req.Recipients {
+		mobile, err := validateMobile(recipient)
+		if err != nil {
+			writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+			return
+		}
+		user, err := getUserOrMakeNew(mobile)
+		if err != nil {
+			writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+			return
+		}
+		users = append(users, user)
+	}
+
+	if err := gosms.SetGroupMembers(mux.Vars(r)["name"], users); err != nil {
+		writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+		return
+	}
+	writeJSON(w, SMSResponse{Status: 200, Message: "ok"})
+}
+
+// returns a single message, allowed methods: GET
+func getSMSHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- getSMSHandler")
+	w.Header().Set("Content-type", "application/json")
+
+	sms, err := gosms.GetMessage(mux.Vars(r)["uuid"])
+	if err != nil {
+		writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+		return
+	}
+	if sms == nil {
+		writeJSON(w, SMSResponse{Status: 404, Message: "message not found"})
+		return
+	}
+	writeJSON(w, SMSItemResponse{Status: 200, Message: "ok", SMS: sms})
+}
+
+// cancels a message that is not sent yet, allowed methods: DELETE
+func cancelSMSHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- cancelSMSHandler")
+	w.Header().Set("Content-type", "application/json")
+
+	uuid := mux.Vars(r)["uuid"]
+	cancelled, err := gosms.CancelMessage(uuid)
+	if err != nil {
+		writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+		return
+	}
+	if !cancelled {
+		writeNotPending(w, uuid)
+		return
+	}
+	writeJSON(w, SMSResponse{Status: 200, Message: "ok"})
+}
+
+// edits body and/or recipient of a message that is not sent yet, allowed methods: PATCH
+func updateSMSHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- updateSMSHandler")
+	w.Header().Set("Content-type", "application/json")
+
+	uuid := mux.Vars(r)["uuid"]
+	sms, err := gosms.GetMessage(uuid)
 	if err != nil {
-		log.Printf("sendMessageToTg: %v", err)
+		writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+		return
+	}
+	if sms == nil {
+		writeJSON(w, SMSResponse{Status: 404, Message: "message not found"})
 		return
 	}
 
-	for _, user := range users {
-		if user.ChatIdTelegram != "" {
-			_, err = Bot.Send(NewUserTg(user.ChatIdTelegram), message)
-			if err != nil {
-				log.Printf("sendMessageToTg: %v", err)
-				continue
-			}
+	r.ParseForm()
+	body := sms.Body
+	if message := r.FormValue("message"); message != "" {
+		body = message
+	}
+	user := sms.User
+	if mobile := r.FormValue("mobile"); mobile != "" {
+		if mobile, err = validateMobile(mobile); err != nil {
+			writeJSON(w, SMSResponse{Status: 400, Message: err.Error()})
+			return
 		}
+		if user, err = getUserOrMakeNew(mobile); err != nil {
+			writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+			return
+		}
+	}
+
+	updated, err := gosms.UpdatePendingMessage(uuid, body, user)
+	if err != nil {
+		writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+		return
+	}
+	if !updated {
+		writeNotPending(w, uuid)
+		return
 	}
+	sms, _ = gosms.GetMessage(uuid)
+	writeJSON(w, SMSItemResponse{Status: 200, Message: "ok", SMS: sms})
 }
 
-func sendMessageToWhatsUp(phoneNumber string, message string) {
-	var (
-		host             = "https://api.green-api.com"
-		idInstance       = "9929"
-		apiTokenInstance = "1af2ef5a2f4450904e02dff12f40dcdbb03e5e36380eac5fac"
-	)
+// health of every device of every channel, allowed methods: GET
+func getDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- getDevicesHandler")
+	w.Header().Set("Content-type", "application/json")
+	writeJSON(w, DevicesResponse{Status: 200, Message: "ok", Devices: gosms.Devices()})
+}
+
+// lists messages that ran out of retries and channels or whose send outcome is unknown, allowed methods: GET
+func getDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- getDeadLetterHandler")
+	w.Header().Set("Content-type", "application/json")
 
-	url := fmt.Sprintf("%s/waInstance%s/sendMessage/%s", host, idInstance, apiTokenInstance)
+	messages, err := gosms.GetMessages("WHERE status IN (?, ?) ORDER BY updated_at DESC", gosms.SMSDeadLetter, gosms.SMSUnknown)
+	if err != nil {
+		writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+		return
+	}
+	writeJSON(w, DeadLetterResponse{Status: 200, Message: "ok", Messages: messages})
+}
+
+// requeues a dead-lettered or unknown message with fresh retries, allowed methods: POST
+func retrySMSHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- retrySMSHandler")
+	w.Header().Set("Content-type", "application/json")
+
+	uuid := mux.Vars(r)["uuid"]
+	requeued, err := gosms.RetryMessage(uuid)
+	if err != nil {
+		writeJSON(w, SMSResponse{Status: 500, Message: err.Error()})
+		return
+	}
+	if !requeued {
+		if sms, _ := gosms.GetMessage(uuid); sms == nil {
+			writeJSON(w, SMSResponse{Status: 404, Message: "message not found"})
+			return
+		}
+		writeJSON(w, SMSResponse{Status: 409, Message: "message is not in dead letter"})
+		return
+	}
+	sms, _ := gosms.GetMessage(uuid)
+	writeJSON(w, SMSItemResponse{Status: 200, Message: "ok", SMS: sms})
+}
 
-	messageWhatsUp := &MessageWhatsUp{
-		ChatId:  fmt.Sprintf("%s@c.us", phoneNumber[1:]),
-		Message: message,
+// writeNotPending ответ на попытку изменить сообщение, которого нет или которое уже отправлено
+func writeNotPending(w http.ResponseWriter, uuid string) {
+	sms, _ := gosms.GetMessage(uuid)
+	if sms == nil {
+		writeJSON(w, SMSResponse{Status: 404, Message: "message not found"})
+		return
+	}
+	if sms.Status == gosms.SMSPending || sms.Status == gosms.SMSError {
+		writeJSON(w, SMSResponse{Status: 409, Message: "message is being sent"})
+		return
 	}
-	requestByte, err := json.Marshal(messageWhatsUp)
-	log.Printf("+%v %s", requestByte, err)
+	writeJSON(w, SMSResponse{Status: 409, Message: "message is not pending"})
+}
 
-	resp, err := http.Post(url, "application/json", bytes.NewReader(requestByte))
+// estimates encoding and number of parts for a message, allowed methods: POST
+func estimateSMSHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- estimateSMSHandler")
+	w.Header().Set("Content-type", "application/json")
+
+	r.ParseForm()
+	message := r.FormValue("message")
 
-	log.Printf("%+v %s", resp, err)
+	estimate := SMSEstimateResponse{Status: 200, Message: "ok", MessageInfo: modem.Estimate(message, false)}
+	toWrite, err := json.Marshal(estimate)
+	if err != nil {
+		log.Println(err)
+		//lets just depend on the server to raise 500
+	}
+	w.Write(toWrite)
 }
 
 // dumps JSON data, used by log view. Methods allowed: GET
@@ -181,11 +667,13 @@ func getLogsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("--- getLogsHandler")
 	messages, _ := gosms.GetMessages("")
 	summary, _ := gosms.GetStatusSummary()
+	channels, _ := gosms.GetChannelSummary()
 	dayCount, _ := gosms.GetLast7DaysMessageCount()
 	logs := SMSDataResponse{
 		Status:   200,
 		Message:  "ok",
 		Summary:  summary,
+		Channels: channels,
 		DayCount: dayCount,
 		Messages: messages,
 	}
@@ -199,8 +687,29 @@ func getLogsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(toWrite)
 }
 
+// dumps received messages. Methods allowed: GET
+func getInboxHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- getInboxHandler")
+	messages, _ := gosms.GetInboundMessages()
+	inbox := InboxResponse{
+		Status:   200,
+		Message:  "ok",
+		Messages: messages,
+	}
+	toWrite, err := json.Marshal(inbox)
+	if err != nil {
+		log.Println(err)
+		//lets just depend on the server to raise 500
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.Write(toWrite)
+}
+
 /* end API handlers */
 
+// httpServer останавливается в shutdown, запросы в работе при этом завершаются
+var httpServer = &http.Server{}
+
 func InitServer(host string, port string, username string, password string) error {
 	log.Println("--- InitServer ", host, port)
 
@@ -218,13 +727,27 @@ func InitServer(host string, port string, username string, password string) erro
 	// all API handlers
 	api := r.PathPrefix("/api").Subrouter()
 	api.Methods("GET").Path("/logs/").HandlerFunc(use(getLogsHandler, basicAuth))
+	api.Methods("GET").Path("/inbox/").HandlerFunc(use(getInboxHandler, basicAuth))
+	api.Methods("GET").Path("/devices/").HandlerFunc(use(getDevicesHandler, basicAuth))
 	api.Methods("POST").Path("/sms/").HandlerFunc(use(sendSMSHandler, basicAuth))
+	api.Methods("POST").Path("/sms/estimate/").HandlerFunc(use(estimateSMSHandler, basicAuth))
+	api.Methods("GET").Path("/sms/{uuid}").HandlerFunc(use(getSMSHandler, basicAuth))
+	api.Methods("DELETE").Path("/sms/{uuid}").HandlerFunc(use(cancelSMSHandler, basicAuth))
+	api.Methods("PATCH").Path("/sms/{uuid}").HandlerFunc(use(updateSMSHandler, basicAuth))
+	api.Methods("POST").Path("/sms/{uuid}/retry").HandlerFunc(use(retrySMSHandler, basicAuth))
+	api.Methods("GET").Path("/deadletter/").HandlerFunc(use(getDeadLetterHandler, basicAuth))
+	api.Methods("POST").Path("/users/route/").HandlerFunc(use(setUserRouteHandler, basicAuth))
+	api.Methods("POST").Path("/users/timezone/").HandlerFunc(use(setUserTimezoneHandler, basicAuth))
+	api.Methods("POST").Path("/batch/").HandlerFunc(use(sendBatchHandler, basicAuth))
+	api.Methods("GET").Path("/batch/{id}/").HandlerFunc(use(getBatchHandler, basicAuth))
+	api.Methods("POST").Path("/groups/{name}/").HandlerFunc(use(setGroupHandler, basicAuth))
 
 	http.Handle("/", r)
 
 	bind := fmt.Sprintf("%s:%s", host, port)
 	log.Println("listening on: ", bind)
-	return http.ListenAndServe(bind, nil)
+	httpServer.Addr = bind
+	return httpServer.ListenAndServe()
 
 }
 
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	tb "go_modules/src/gopkg.in/tucnak/telebot.v2"
 	"gosms"
+	"gosms/transport"
 	"log"
 	"regexp"
 	"strconv"
@@ -11,6 +13,9 @@ import (
 
 var Bot *tb.Bot
 
+// Telegram канал доставки через бота
+var Telegram *TelegramTransport
+
 func initTgBot() {
 	var err error
 	Bot, err = tb.NewBot(tb.Settings{
@@ -34,6 +39,8 @@ func initTgBot() {
 
 	Bot.Handle(tb.OnText, getPhoneNumberFromUser)
 
+	Telegram = NewTelegramTransport(Bot)
+
 	go Bot.Start()
 }
 
@@ -102,3 +109,54 @@ func NewUserTg(chatId string) *UserTg {
 func (u *UserTg) Recipient() string {
 	return u.chatId
 }
+
+// TelegramTransport отправка сообщений во все чаты, привязанные к номеру получателя
+type TelegramTransport struct {
+	bot *tb.Bot
+}
+
+func NewTelegramTransport(bot *tb.Bot) *TelegramTransport {
+	return &TelegramTransport{bot: bot}
+}
+
+func (t *TelegramTransport) ID() string {
+	return "telegram"
+}
+
+// Send отправляет сообщение, ошибка ErrNoRecipient если номер не привязан ни к одному чату
+func (t *TelegramTransport) Send(ctx context.Context, msg transport.Message) (transport.Result, error) {
+	users, err := gosms.GetUsersByPhoneNumber(msg.To)
+	if err != nil {
+		return transport.Result{Status: transport.StatusFailed}, err
+	}
+
+	result := transport.Result{Status: transport.StatusFailed}
+	err = transport.ErrNoRecipient
+	for _, user := range users {
+		if user.ChatIdTelegram == "" {
+			continue
+		}
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		sent, sendErr := t.bot.Send(NewUserTg(user.ChatIdTelegram), msg.Body)
+		if sendErr != nil {
+			log.Printf("TelegramTransport: %v", sendErr)
+			if result.Status != transport.StatusSent {
+				err = sendErr
+			}
+			continue
+		}
+		result.Status = transport.StatusSent
+		result.ProviderID = strconv.Itoa(sent.ID)
+		err = nil
+	}
+	return result, err
+}
+
+func (t *TelegramTransport) Health() transport.Health {
+	if t.bot == nil {
+		return transport.Health{Healthy: false, Reason: "bot is not initialized"}
+	}
+	return transport.Health{Healthy: true}
+}
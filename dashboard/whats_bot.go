@@ -1,7 +1,21 @@
 package main
 
-func initWhatsBot() {
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gosms/transport"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// WhatsApp канал доставки через green-api
+var WhatsApp *WhatsAppTransport
 
+func initWhatsBot() {
+	WhatsApp = NewWhatsAppTransport("https://api.green-api.com", "9929", "1af2ef5a2f4450904e02dff12f40dcdbb03e5e36380eac5fac")
 }
 
 // MessageWhatsUp структура для отправки сообщений whats up
@@ -9,3 +23,68 @@ type MessageWhatsUp struct {
 	ChatId  string `json:"chatId"`
 	Message string `json:"message"`
 }
+
+// sendMessageResponseWhatsUp ответ green-api на sendMessage
+type sendMessageResponseWhatsUp struct {
+	IdMessage string `json:"idMessage"`
+}
+
+// WhatsAppTransport отправка сообщений в WhatsApp через инстанс green-api
+type WhatsAppTransport struct {
+	host             string
+	idInstance       string
+	apiTokenInstance string
+}
+
+func NewWhatsAppTransport(host, idInstance, apiTokenInstance string) *WhatsAppTransport {
+	return &WhatsAppTransport{host: host, idInstance: idInstance, apiTokenInstance: apiTokenInstance}
+}
+
+func (t *WhatsAppTransport) ID() string {
+	return "whatsapp"
+}
+
+func (t *WhatsAppTransport) Send(ctx context.Context, msg transport.Message) (transport.Result, error) {
+	url := fmt.Sprintf("%s/waInstance%s/sendMessage/%s", t.host, t.idInstance, t.apiTokenInstance)
+
+	number := strings.TrimPrefix(msg.To, "+")
+	if number == "" {
+		return transport.Result{Status: transport.StatusFailed}, transport.Permanent(fmt.Errorf("green-api: invalid number %q", msg.To))
+	}
+	messageWhatsUp := &MessageWhatsUp{
+		ChatId:  fmt.Sprintf("%s@c.us", number),
+		Message: msg.Body,
+	}
+	requestByte, err := json.Marshal(messageWhatsUp)
+	if err != nil {
+		return transport.Result{Status: transport.StatusFailed}, err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(requestByte))
+	if err != nil {
+		return transport.Result{Status: transport.StatusFailed}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return transport.Result{Status: transport.StatusUnknown}, err
+	}
+	defer resp.Body.Close()
+	log.Printf("WhatsAppTransport: %s %s", msg.To, resp.Status)
+
+	if resp.StatusCode != http.StatusOK {
+		return transport.Result{Status: transport.StatusFailed}, fmt.Errorf("green-api: %s", resp.Status)
+	}
+
+	var sent sendMessageResponseWhatsUp
+	if err = json.NewDecoder(resp.Body).Decode(&sent); err != nil {
+		return transport.Result{Status: transport.StatusUnknown}, err
+	}
+	return transport.Result{Status: transport.StatusSent, ProviderID: sent.IdMessage}, nil
+}
+
+func (t *WhatsAppTransport) Health() transport.Health {
+	return transport.Health{Healthy: true}
+}
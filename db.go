@@ -5,12 +5,76 @@ import (
 	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
+	"gosms/transport"
 	"log"
 	"os"
+	"strings"
+	"time"
 )
 
 var db *sql.DB
 
+// migrations изменения схемы, применяются при каждом запуске и к уже существующим базам
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS inbound_messages (
+      id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+      sender char(32) NOT NULL,
+      message TEXT NOT NULL,
+      device string NULL,
+      sent_at TIMESTAMP,
+      created_at TIMESTAMP default CURRENT_TIMESTAMP
+);`,
+	`CREATE TABLE IF NOT EXISTS message_parts (
+      id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+      message_uuid char(32) NOT NULL,
+      part INTEGER NOT NULL,
+      device string NULL,
+      reference INTEGER NOT NULL,
+      status INTEGER DEFAULT 1,
+      updated_at TIMESTAMP,
+      FOREIGN KEY (message_uuid) REFERENCES messages(uuid)
+);`,
+	`ALTER TABLE messages ADD COLUMN delivered_at TIMESTAMP`,
+	`ALTER TABLE messages ADD COLUMN route TEXT DEFAULT 'sms'`,
+	`ALTER TABLE messages ADD COLUMN channel TEXT DEFAULT 'sms'`,
+	`ALTER TABLE messages ADD COLUMN fallback_at TIMESTAMP`,
+	`ALTER TABLE usr ADD COLUMN route TEXT DEFAULT ''`,
+	`ALTER TABLE messages ADD COLUMN provider_id TEXT`,
+	`ALTER TABLE messages ADD COLUMN error TEXT`,
+	`ALTER TABLE messages ADD COLUMN parent_uuid char(32)`,
+	`ALTER TABLE messages ADD COLUMN batch_id char(32)`,
+	`ALTER TABLE messages ADD COLUMN send_at TIMESTAMP`,
+	`ALTER TABLE messages ADD COLUMN marketing INTEGER DEFAULT 0`,
+	`ALTER TABLE usr ADD COLUMN timezone TEXT DEFAULT ''`,
+	`ALTER TABLE messages ADD COLUMN priority INTEGER DEFAULT 1`,
+	`ALTER TABLE messages ADD COLUMN next_attempt_at TIMESTAMP`,
+	`ALTER TABLE messages ADD COLUMN error_code INTEGER DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS usr_groups (
+      id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+      name char(64) NOT NULL,
+      fk_usr integer NOT NULL,
+      FOREIGN KEY (fk_usr) REFERENCES usr(id)
+);`,
+	`ALTER TABLE messages ADD COLUMN sending INTEGER DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS device_usage (
+      id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+      device string NOT NULL,
+      parts INTEGER NOT NULL,
+      sent_at TIMESTAMP default CURRENT_TIMESTAMP
+);`,
+	`CREATE INDEX IF NOT EXISTS device_usage_sent ON device_usage(device, sent_at)`,
+	`CREATE TABLE IF NOT EXISTS device_balance (
+      id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+      device string NOT NULL,
+      balance REAL NULL,
+      response TEXT NOT NULL,
+      checked_at TIMESTAMP default CURRENT_TIMESTAMP
+);`,
+	`CREATE INDEX IF NOT EXISTS device_balance_checked ON device_balance(device, checked_at)`,
+	`ALTER TABLE messages ADD COLUMN locked_by TEXT`,
+	`ALTER TABLE messages ADD COLUMN lease_until TIMESTAMP`,
+}
+
 func InitDB(driver, dbname string) (*sql.DB, error) {
 	var err error
 	createDb := false
@@ -24,9 +88,25 @@ func InitDB(driver, dbname string) (*sql.DB, error) {
 			return nil, errors.New("Error creating database")
 		}
 	}
+	if err = migrateDB(); err != nil {
+		return nil, errors.New("Error migrating database")
+	}
 	return db, nil
 }
 
+// migrateDB применяет migrations, повторное добавление столбца не считается ошибкой
+func migrateDB() error {
+	log.Println("--- migrateDB")
+	for _, migration := range migrations {
+		_, err := db.Exec(migration)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			log.Println("migrateDB: ", err)
+			return err
+		}
+	}
+	return nil
+}
+
 func syncDB() error {
 	log.Println("--- syncDB")
 	//create messages table
@@ -42,7 +122,7 @@ CREATE TABLE messages (
       id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
       fk_usr integer NOT NULL,
       uuid char(32) UNIQUE NOT NULL,
-      message char(160)   NOT NULL,
+      message TEXT   NOT NULL,
       status  INTEGER DEFAULT 0,
       retries INTEGER DEFAULT 0,
       device string NULL,
@@ -62,13 +142,13 @@ func insertMessage(sms *SMS) error {
 		log.Println("insertMessage: ", err)
 		return err
 	}
-	stmt, err := tx.Prepare("INSERT INTO messages(uuid, message, fk_usr) VALUES(?, ?, ?)")
+	stmt, err := tx.Prepare("INSERT INTO messages(uuid, message, fk_usr, route, channel, parent_uuid, batch_id, send_at, marketing, priority) VALUES(?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?, ?)")
 	if err != nil {
 		log.Println("insertMessage: ", err)
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(sms.UUID, sms.Body, sms.User.ID)
+	_, err = stmt.Exec(sms.UUID, sms.Body, sms.User.ID, sms.Route, sms.Channel, sms.ParentUUID, sms.BatchID, sms.SendAt, sms.Marketing, sms.Priority)
 	if err != nil {
 		log.Println("insertMessage: ", err)
 		return err
@@ -84,13 +164,13 @@ func InsertUser(user *User) (*User, error) {
 		log.Println("insertUser: ", err)
 		return nil, err
 	}
-	stmt, err := tx.Prepare("INSERT INTO usr(phone_number, chat_id_telegram) VALUES(?, ?)")
+	stmt, err := tx.Prepare("INSERT INTO usr(phone_number, chat_id_telegram, route) VALUES(?, ?, ?)")
 	if err != nil {
 		log.Println("insertUser: ", err)
 		return nil, err
 	}
 	defer stmt.Close()
-	res, err := stmt.Exec(user.PhoneNumber, user.ChatIdTelegram)
+	res, err := stmt.Exec(user.PhoneNumber, user.ChatIdTelegram, user.Route)
 	if err != nil {
 		log.Println("insertUser: ", err)
 		return nil, err
@@ -113,13 +193,13 @@ func UpdateUser(user *User) error {
 		log.Println("updateUser: ", err)
 		return err
 	}
-	stmt, err := tx.Prepare("UPDATE usr SET phone_number = ?, chat_id_telegram = ? WHERE id = ?")
+	stmt, err := tx.Prepare("UPDATE usr SET phone_number = ?, chat_id_telegram = ?, route = ? WHERE id = ?")
 	if err != nil {
 		log.Println("updateUser: ", err)
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(user.PhoneNumber, user.ChatIdTelegram, user.ID)
+	_, err = stmt.Exec(user.PhoneNumber, user.ChatIdTelegram, user.Route, user.ID)
 	if err != nil {
 		log.Println("updateUser: ", err)
 		return err
@@ -134,7 +214,7 @@ func UpdateUser(user *User) error {
 func GetUserByPhoneNumber(phoneNumber string) (*User, error) {
 	log.Println("--- getUserByPhoneNumber ")
 
-	query := "SELECT id, phone_number, chat_id_telegram FROM usr WHERE phone_number = ? LIMIT 1"
+	query := "SELECT id, phone_number, COALESCE(chat_id_telegram, ''), COALESCE(route, ''), COALESCE(timezone, '') FROM usr WHERE phone_number = ? LIMIT 1"
 	log.Println("getUserByPhoneNumber: ", query)
 
 	row := db.QueryRow(query, phoneNumber)
@@ -145,7 +225,7 @@ func GetUserByPhoneNumber(phoneNumber string) (*User, error) {
 	}
 
 	user := &User{}
-	row.Scan(&user.ID, &user.PhoneNumber, &user.ChatIdTelegram)
+	row.Scan(&user.ID, &user.PhoneNumber, &user.ChatIdTelegram, &user.Route, &user.Timezone)
 
 	return user, nil
 }
@@ -154,7 +234,7 @@ func GetUserByPhoneNumber(phoneNumber string) (*User, error) {
 func GetUserByChatIdTg(chatID string) (*User, error) {
 	log.Println("--- GetUserByChatIdTg ")
 
-	query := "SELECT id, phone_number, chat_id_telegram FROM usr WHERE chat_id_telegram = ? LIMIT 1"
+	query := "SELECT id, phone_number, COALESCE(chat_id_telegram, ''), COALESCE(route, ''), COALESCE(timezone, '') FROM usr WHERE chat_id_telegram = ? LIMIT 1"
 	log.Println("GetUserByChatIdTg: ", query)
 
 	row := db.QueryRow(query, chatID)
@@ -165,7 +245,7 @@ func GetUserByChatIdTg(chatID string) (*User, error) {
 	}
 
 	user := &User{}
-	row.Scan(&user.ID, &user.PhoneNumber, &user.ChatIdTelegram)
+	row.Scan(&user.ID, &user.PhoneNumber, &user.ChatIdTelegram, &user.Route, &user.Timezone)
 
 	return user, nil
 }
@@ -174,7 +254,7 @@ func GetUserByChatIdTg(chatID string) (*User, error) {
 func GetUsersByPhoneNumber(phoneNumber string) ([]*User, error) {
 	log.Println("--- getUsersByPhoneNumber ")
 
-	query := "SELECT id, phone_number, chat_id_telegram FROM usr WHERE phone_number = ?"
+	query := "SELECT id, phone_number, COALESCE(chat_id_telegram, ''), COALESCE(route, ''), COALESCE(timezone, '') FROM usr WHERE phone_number = ?"
 	log.Println("getUsersByPhoneNumber: ", query)
 
 	rows, err := db.Query(query, phoneNumber)
@@ -189,7 +269,7 @@ func GetUsersByPhoneNumber(phoneNumber string) ([]*User, error) {
 
 	for rows.Next() {
 		user := &User{}
-		err = rows.Scan(&user.ID, &user.PhoneNumber, &user.ChatIdTelegram)
+		err = rows.Scan(&user.ID, &user.PhoneNumber, &user.ChatIdTelegram, &user.Route, &user.Timezone)
 
 		if err != nil{
 			log.Println("getUsersByPhoneNumber: ", err)
@@ -201,6 +281,51 @@ func GetUsersByPhoneNumber(phoneNumber string) ([]*User, error) {
 	return users, nil
 }
 
+// UpdateRouteByPhoneNumber сохраняет политику доставки для всех пользователей с номером
+func UpdateRouteByPhoneNumber(phoneNumber, route string) error {
+	log.Println("--- UpdateRouteByPhoneNumber ", phoneNumber, route)
+	_, err := db.Exec("UPDATE usr SET route = ? WHERE phone_number = ?", route, phoneNumber)
+	if err != nil {
+		log.Println("UpdateRouteByPhoneNumber: ", err)
+	}
+	return err
+}
+
+// UpdateTimezoneByPhoneNumber сохраняет часовой пояс для всех пользователей с номером
+func UpdateTimezoneByPhoneNumber(phoneNumber, timezone string) error {
+	log.Println("--- UpdateTimezoneByPhoneNumber ", phoneNumber, timezone)
+	_, err := db.Exec("UPDATE usr SET timezone = ? WHERE phone_number = ?", timezone, phoneNumber)
+	if err != nil {
+		log.Println("UpdateTimezoneByPhoneNumber: ", err)
+	}
+	return err
+}
+
+// deferMessage откладывает отправку сообщения до sendAt, попытки не расходуются
+func deferMessage(uuid string, sendAt time.Time) error {
+	log.Println("--- deferMessage ", uuid, sendAt)
+	_, err := db.Exec("UPDATE messages SET send_at = ?, sending = 0, locked_by = NULL, lease_until = NULL, updated_at = DATETIME('now') WHERE uuid = ?",
+		sendAt.UTC().Format(timeFormat), uuid)
+	if err != nil {
+		log.Println("deferMessage: ", err)
+	}
+	return err
+}
+
+// getNextSendAt ближайшее время отложенной отправки, повтора или окончания чужой аренды,
+// false если таких сообщений нет
+func getNextSendAt() (time.Time, bool) {
+	var sendAt string
+	err := db.QueryRow(`SELECT COALESCE(MIN(MAX(COALESCE(send_at, ''), COALESCE(next_attempt_at, ''), COALESCE(lease_until, ''))), '') FROM messages
+    WHERE status IN (?, ?) AND retries < ? AND MAX(COALESCE(send_at, ''), COALESCE(next_attempt_at, ''), COALESCE(lease_until, '')) > DATETIME('now')`,
+		SMSPending, SMSError, SMSRetryLimit).Scan(&sendAt)
+	if err != nil || sendAt == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(timeFormat, sendAt)
+	return t, err == nil
+}
+
 func updateMessageStatus(sms SMS) error {
 	log.Println("--- updateMessageStatus ", sms)
 	tx, err := db.Begin()
@@ -208,27 +333,213 @@ func updateMessageStatus(sms SMS) error {
 		log.Println("updateMessageStatus: ", err)
 		return err
 	}
-	stmt, err := tx.Prepare("UPDATE messages SET status=?, retries=?, device=?, updated_at=DATETIME('now') WHERE uuid=?")
+	stmt, err := tx.Prepare("UPDATE messages SET status=?, retries=?, device=?, fallback_at=NULLIF(?, ''), provider_id=NULLIF(?, ''), error=NULLIF(?, ''), error_code=?, next_attempt_at=NULLIF(?, ''), sending=0, locked_by=NULL, lease_until=NULL, updated_at=DATETIME('now') WHERE uuid=? AND COALESCE(locked_by, '')=?")
 	if err != nil {
 		log.Println("updateMessageStatus: ", err)
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(sms.Status, sms.Retries, sms.Device, sms.UUID)
+	res, err := stmt.Exec(sms.Status, sms.Retries, sms.Device, sms.FallbackAt, sms.ProviderID, sms.Error, sms.ErrorCode, sms.NextAttemptAt, sms.UUID, sms.lease)
 	if err != nil {
 		log.Println("updateMessageStatus: ", err)
 		return err
 	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		// аренда истекла, и сообщение забрал другой загрузчик: его результат важнее
+		log.Println("updateMessageStatus: ", sms.UUID, "lease", sms.lease, "lost, status not saved")
+	}
 	tx.Commit()
 	return nil
 }
 
+// replaceMessageParts сохраняет TP-MR частей отправленного сообщения вместо прошлой попытки
+func replaceMessageParts(uuid, device string, parts []transport.Part) error {
+	log.Println("--- replaceMessageParts ", uuid, parts)
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("replaceMessageParts: ", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("DELETE FROM message_parts WHERE message_uuid = ?", uuid); err != nil {
+		log.Println("replaceMessageParts: ", err)
+		return err
+	}
+	for _, part := range parts {
+		status := SMSProcessed
+		if part.Reference < 0 {
+			if part.Status == transport.StatusSent {
+				continue
+			}
+			// часть без TP-MR: отчета о ней не будет, и сообщение не станет доставленным само
+			status = SMSUnknown
+		}
+		_, err = tx.Exec("INSERT INTO message_parts(message_uuid, part, device, reference, status, updated_at) VALUES(?, ?, ?, ?, ?, DATETIME('now'))",
+			uuid, part.Part, device, part.Reference, status)
+		if err != nil {
+			log.Println("replaceMessageParts: ", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// getDeviceCounters отправленных и неудачных сообщений по устройствам
+func getDeviceCounters() (map[string][2]int, error) {
+	log.Println("--- getDeviceCounters")
+	rows, err := db.Query(`SELECT device,
+    SUM(CASE WHEN status IN (?, ?) THEN 1 ELSE 0 END),
+    SUM(CASE WHEN status IN (?, ?, ?, ?) THEN 1 ELSE 0 END)
+    FROM messages WHERE device IS NOT NULL AND device != '' GROUP BY device`,
+		SMSProcessed, SMSDelivered, SMSError, SMSExpired, SMSRejected, SMSDeadLetter)
+	if err != nil {
+		log.Println("getDeviceCounters: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	counters := make(map[string][2]int)
+	for rows.Next() {
+		var device string
+		var sent, failed int
+		if err = rows.Scan(&device, &sent, &failed); err != nil {
+			log.Println("getDeviceCounters: ", err)
+			return nil, err
+		}
+		counters[device] = [2]int{sent, failed}
+	}
+	return counters, nil
+}
+
+// recordDeviceUsage учитывает отправленные устройством части для ограничений,
+// записи старше прошлого месяца больше не нужны и удаляются
+func recordDeviceUsage(device string, parts int) error {
+	if parts <= 0 {
+		return nil
+	}
+	_, err := db.Exec("INSERT INTO device_usage(device, parts, sent_at) VALUES(?, ?, DATETIME('now'))", device, parts)
+	if err != nil {
+		log.Println("recordDeviceUsage: ", err)
+		return err
+	}
+	_, err = db.Exec("DELETE FROM device_usage WHERE sent_at < DATETIME('now', 'start of month', '-1 month')")
+	if err != nil {
+		log.Println("recordDeviceUsage: ", err)
+	}
+	return err
+}
+
+// getDeviceUsage частей, отправленных устройством начиная с since, и время самой ранней отправки
+func getDeviceUsage(device string, since time.Time) (int, time.Time, error) {
+	var parts int
+	var oldest string
+	err := db.QueryRow("SELECT COALESCE(SUM(parts), 0), COALESCE(MIN(sent_at), '') FROM device_usage WHERE device = ? AND sent_at >= ?",
+		device, since.UTC().Format(timeFormat)).Scan(&parts, &oldest)
+	if err != nil {
+		log.Println("getDeviceUsage: ", err)
+		return 0, time.Time{}, err
+	}
+	oldestTime, _ := time.Parse(timeFormat, oldest)
+	return parts, oldestTime, nil
+}
+
+// recordBalance сохраняет ответ на запрос баланса, amount nil если сумма не разобрана
+func recordBalance(device string, amount *float64, response string) error {
+	_, err := db.Exec("INSERT INTO device_balance(device, balance, response, checked_at) VALUES(?, ?, ?, DATETIME('now'))",
+		device, amount, response)
+	if err != nil {
+		log.Println("recordBalance: ", err)
+	}
+	return err
+}
+
+// getLastBalance последний сохраненный баланс устройства и время запроса, нулевое если его не было
+func getLastBalance(device string) (Balance, time.Time) {
+	var balance Balance
+	var amount sql.NullFloat64
+	err := db.QueryRow("SELECT balance, response, checked_at FROM device_balance WHERE device = ? ORDER BY checked_at DESC, id DESC LIMIT 1",
+		device).Scan(&amount, &balance.Response, &balance.CheckedAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("getLastBalance: ", err)
+		}
+		return Balance{}, time.Time{}
+	}
+	if amount.Valid {
+		balance.Amount = &amount.Float64
+	}
+	checkedAt, _ := time.Parse(timeFormat, balance.CheckedAt)
+	return balance, checkedAt
+}
+
+// updateMessagePartStatus отмечает последнюю часть с данным TP-MR на устройстве
+// и выставляет итоговый статус сообщения, когда известна судьба всех частей
+func updateMessagePartStatus(device string, reference, status int, deliveredAt string) error {
+	log.Println("--- updateMessagePartStatus ", device, reference, status)
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("updateMessagePartStatus: ", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var uuid string
+	err = tx.QueryRow("SELECT id, message_uuid FROM message_parts WHERE device = ? AND reference = ? AND status = ? ORDER BY id DESC LIMIT 1",
+		device, reference, SMSProcessed).Scan(&id, &uuid)
+	if err == sql.ErrNoRows {
+		log.Println("updateMessagePartStatus: no message part for reference", reference)
+		return nil
+	}
+	if err != nil {
+		log.Println("updateMessagePartStatus: ", err)
+		return err
+	}
+	if _, err = tx.Exec("UPDATE message_parts SET status = ?, updated_at = DATETIME('now') WHERE id = ?", status, id); err != nil {
+		log.Println("updateMessagePartStatus: ", err)
+		return err
+	}
+
+	var total, delivered, expired, rejected int
+	err = tx.QueryRow(`SELECT COUNT(id), COALESCE(SUM(status = ?), 0), COALESCE(SUM(status = ?), 0), COALESCE(SUM(status = ?), 0)
+    FROM message_parts WHERE message_uuid = ?`, SMSDelivered, SMSExpired, SMSRejected, uuid).Scan(&total, &delivered, &expired, &rejected)
+	if err != nil {
+		log.Println("updateMessagePartStatus: ", err)
+		return err
+	}
+
+	messageStatus := SMSProcessed
+	if rejected > 0 {
+		messageStatus = SMSRejected
+	} else if expired > 0 {
+		messageStatus = SMSExpired
+	} else if delivered == total {
+		messageStatus = SMSDelivered
+	}
+	if messageStatus != SMSProcessed {
+		_, err = tx.Exec("UPDATE messages SET status = ?, delivered_at = ?, updated_at = DATETIME('now') WHERE uuid = ? AND status IN (?, ?)",
+			messageStatus, deliveredAt, uuid, SMSProcessed, SMSUnknown)
+		if err != nil {
+			log.Println("updateMessagePartStatus: ", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// getPendingMessages до bufferSize сообщений, готовых к отправке, на каждое берется аренда:
+// пока она не истекла, другие загрузчики, в том числе других экземпляров шлюза с той же
+// базой, его не получат
 func getPendingMessages(bufferSize int) ([]SMS, error) {
 	log.Println("--- getPendingMessages ")
-	query := fmt.Sprintf("SELECT uuid, message, status, retries, phone_number " +
+	query := fmt.Sprintf("SELECT uuid, message, status, retries, fk_usr, phone_number, COALESCE(timezone, ''), messages.route, channel, COALESCE(batch_id, ''), marketing, priority " +
 		" FROM messages LEFT JOIN usr  ON usr.id = messages.fk_usr " +
-		" WHERE status!=%v AND retries<%v LIMIT %v",
-		SMSProcessed, SMSRetryLimit, bufferSize)
+		" WHERE status IN (%v, %v) AND retries<%v AND (send_at IS NULL OR send_at <= DATETIME('now')) " +
+		" AND (next_attempt_at IS NULL OR next_attempt_at <= DATETIME('now')) " +
+		" AND (lease_until IS NULL OR lease_until <= DATETIME('now')) " +
+		" ORDER BY priority, created_at LIMIT %v",
+		SMSPending, SMSError, SMSRetryLimit, bufferSize)
 	log.Println("getPendingMessages: ", query)
 
 	rows, err := db.Query(query)
@@ -244,24 +555,165 @@ func getPendingMessages(bufferSize int) ([]SMS, error) {
 		sms := SMS{
 			User: &User{},
 		}
-		rows.Scan(&sms.UUID, &sms.Body, &sms.Status, &sms.Retries, &sms.User.PhoneNumber)
+		rows.Scan(&sms.UUID, &sms.Body, &sms.Status, &sms.Retries, &sms.User.ID, &sms.User.PhoneNumber, &sms.User.Timezone, &sms.Route, &sms.Channel, &sms.BatchID, &sms.Marketing, &sms.Priority)
 		messages = append(messages, sms)
 	}
 	rows.Close()
+
+	// после выборки часть из них мог забрать другой загрузчик
+	claimed := messages[:0]
+	for _, sms := range messages {
+		if claimMessage(&sms) {
+			claimed = append(claimed, sms)
+		}
+	}
+	return claimed, nil
+}
+
+// claimMessage берет аренду на LeaseTimeout, если сообщение все еще ждет отправки и
+// не арендовано, false если его уже забрал кто-то другой
+func claimMessage(sms *SMS) bool {
+	lease := newLease()
+	res, err := db.Exec(`UPDATE messages SET sending = 0, locked_by = ?, lease_until = ? WHERE uuid = ? AND status IN (?, ?)
+    AND (lease_until IS NULL OR lease_until <= DATETIME('now'))`,
+		lease, time.Now().UTC().Add(LeaseTimeout).Format(timeFormat), sms.UUID, SMSPending, SMSError)
+	if err != nil {
+		log.Println("claimMessage: ", err)
+		return false
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		log.Println("claimMessage: ", sms.UUID, "already claimed")
+		return false
+	}
+	sms.lease = lease
+	return true
+}
+
+// renewLease продлевает аренду на время d и отмечает, что сообщение уходит в канал: пока
+// аренда не истечет, его нельзя отменить или изменить. false если она истекла и сообщение
+// забрал другой загрузчик или его отменили, пока оно ждало в очереди
+func renewLease(sms SMS, d time.Duration) bool {
+	res, err := db.Exec("UPDATE messages SET sending = 1, lease_until = ? WHERE uuid = ? AND locked_by = ? AND status IN (?, ?)",
+		time.Now().UTC().Add(d).Format(timeFormat), sms.UUID, sms.lease, SMSPending, SMSError)
+	if err != nil {
+		log.Println("renewLease: ", err)
+		return false
+	}
+	affected, _ := res.RowsAffected()
+	return affected > 0
+}
+
+// releaseLease снимает аренду с сообщения, которое так и не отправлялось
+func releaseLease(sms SMS) error {
+	_, err := db.Exec("UPDATE messages SET sending = 0, locked_by = NULL, lease_until = NULL WHERE uuid = ? AND locked_by = ?",
+		sms.UUID, sms.lease)
+	if err != nil {
+		log.Println("releaseLease: ", err)
+	}
+	return err
+}
+
+// getDueFallbacks отправленные, но не доставленные сообщения, у которых истекло ожидание перед следующим каналом
+func getDueFallbacks() ([]SMS, error) {
+	log.Println("--- getDueFallbacks ")
+	rows, err := db.Query(`SELECT uuid, message, status, retries, fk_usr, phone_number, COALESCE(timezone, ''), messages.route, channel, COALESCE(batch_id, ''), marketing, priority
+    FROM messages LEFT JOIN usr ON usr.id = messages.fk_usr
+    WHERE status = ? AND fallback_at IS NOT NULL AND fallback_at <= DATETIME('now')`, SMSProcessed)
+	if err != nil {
+		log.Println("getDueFallbacks: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []SMS
+	for rows.Next() {
+		sms := SMS{
+			User: &User{},
+		}
+		rows.Scan(&sms.UUID, &sms.Body, &sms.Status, &sms.Retries, &sms.User.ID, &sms.User.PhoneNumber, &sms.User.Timezone, &sms.Route, &sms.Channel, &sms.BatchID, &sms.Marketing, &sms.Priority)
+		messages = append(messages, sms)
+	}
 	return messages, nil
 }
 
-func GetMessages(filter string) ([]SMS, error) {
+// GetMessage получение сообщения по uuid, nil если такого нет
+func GetMessage(uuid string) (*SMS, error) {
+	messages, err := GetMessages("WHERE uuid = ?", uuid)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return &messages[0], nil
+}
+
+// requeueDeadLetter возвращает сообщение из dead letter или с неизвестным исходом отправки
+// в ожидание с новыми попытками; ошибки, исчерпавшие попытки до появления dead letter, тоже
+// принимаются. false если сообщение не найдено или не ждет ручного повтора
+func requeueDeadLetter(uuid string) (bool, error) {
+	log.Println("--- requeueDeadLetter ", uuid)
+	res, err := db.Exec(`UPDATE messages SET status = ?, retries = 0, next_attempt_at = NULL, sending = 0, locked_by = NULL, lease_until = NULL, updated_at = DATETIME('now')
+    WHERE uuid = ? AND (status IN (?, ?) OR (status = ? AND retries >= ?))`,
+		SMSPending, uuid, SMSDeadLetter, SMSUnknown, SMSError, SMSRetryLimit)
+	if err != nil {
+		log.Println("requeueDeadLetter: ", err)
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// CancelMessage отменяет сообщение, которое еще не отправлено; false если отменять уже нечего
+func CancelMessage(uuid string) (bool, error) {
+	log.Println("--- CancelMessage ", uuid)
+	res, err := db.Exec("UPDATE messages SET status = ?, updated_at = DATETIME('now') WHERE uuid = ? AND status IN (?, ?) AND "+notSending,
+		SMSCancelled, uuid, SMSPending, SMSError)
+	if err != nil {
+		log.Println("CancelMessage: ", err)
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// notSending условие: сообщение не отправляется прямо сейчас, см. renewLease. Отметка
+// упавшего экземпляра перестает действовать вместе с его арендой
+const notSending = "NOT (sending = 1 AND COALESCE(lease_until, '') > DATETIME('now'))"
+
+// UpdatePendingMessage меняет текст и получателя сообщения, которое еще не отправлено
+func UpdatePendingMessage(uuid, body string, user *User) (bool, error) {
+	log.Println("--- UpdatePendingMessage ", uuid)
+	res, err := db.Exec("UPDATE messages SET message = ?, fk_usr = ?, updated_at = DATETIME('now') WHERE uuid = ? AND status IN (?, ?) AND "+notSending,
+		body, user.ID, uuid, SMSPending, SMSError)
+	if err != nil {
+		log.Println("UpdatePendingMessage: ", err)
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// clearFallback снимает ожидание перехода к следующему каналу
+func clearFallback(uuid string) error {
+	_, err := db.Exec("UPDATE messages SET fallback_at = NULL, updated_at = DATETIME('now') WHERE uuid = ?", uuid)
+	if err != nil {
+		log.Println("clearFallback: ", err)
+	}
+	return err
+}
+
+func GetMessages(filter string, args ...interface{}) ([]SMS, error) {
 	/*
 	   expecting filter as empty string or WHERE clauses,
-	   simply append it to the query to get desired set out of database
+	   simply append it to the query to get desired set out of database,
+	   args are bound to ? placeholders in filter
 	*/
 	log.Println("--- GetMessages")
-	query := fmt.Sprintf("SELECT uuid, message, status, retries, phone_number, device, created_at, updated_at " +
+	query := fmt.Sprintf("SELECT uuid, message, status, retries, fk_usr, phone_number, COALESCE(timezone, ''), messages.route, channel, COALESCE(fallback_at, ''), " +
+		"COALESCE(provider_id, ''), COALESCE(error, ''), COALESCE(parent_uuid, ''), COALESCE(batch_id, ''), COALESCE(device, ''), created_at, COALESCE(updated_at, ''), COALESCE(delivered_at, ''), " +
+		"COALESCE(send_at, ''), marketing, priority, COALESCE(next_attempt_at, ''), COALESCE(error_code, 0) " +
 		" FROM messages LEFT JOIN usr ON usr.id = messages.fk_usr %v", filter)
 	log.Println("GetMessages: ", query)
 
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		log.Println("GetMessages: ", err)
 		return nil, err
@@ -274,13 +726,48 @@ func GetMessages(filter string) ([]SMS, error) {
 		sms := SMS{
 			User: &User{},
 		}
-		rows.Scan(&sms.UUID, &sms.Body, &sms.Status, &sms.Retries, &sms.User.PhoneNumber, &sms.Device, &sms.CreatedAt, &sms.UpdatedAt)
+		rows.Scan(&sms.UUID, &sms.Body, &sms.Status, &sms.Retries, &sms.User.ID, &sms.User.PhoneNumber, &sms.User.Timezone, &sms.Route, &sms.Channel, &sms.FallbackAt,
+			&sms.ProviderID, &sms.Error, &sms.ParentUUID, &sms.BatchID, &sms.Device, &sms.CreatedAt, &sms.UpdatedAt, &sms.DeliveredAt,
+			&sms.SendAt, &sms.Marketing, &sms.Priority, &sms.NextAttemptAt, &sms.ErrorCode)
 		messages = append(messages, sms)
 	}
 	rows.Close()
 	return messages, nil
 }
 
+func insertInboundMessage(sms *InboundSMS) error {
+	log.Println("--- insertInboundMessage ", sms)
+	res, err := db.Exec("INSERT INTO inbound_messages(sender, message, device, sent_at) VALUES(?, ?, ?, ?)",
+		sms.Sender, sms.Body, sms.Device, sms.SentAt)
+	if err != nil {
+		log.Println("insertInboundMessage: ", err)
+		return err
+	}
+	sms.ID, _ = res.LastInsertId()
+	return nil
+}
+
+// GetInboundMessages получение входящих сообщений, новые первыми
+func GetInboundMessages() ([]InboundSMS, error) {
+	log.Println("--- GetInboundMessages")
+
+	rows, err := db.Query(`SELECT id, sender, message, device, sent_at, created_at
+    FROM inbound_messages ORDER BY id DESC`)
+	if err != nil {
+		log.Println("GetInboundMessages: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []InboundSMS
+	for rows.Next() {
+		sms := InboundSMS{}
+		rows.Scan(&sms.ID, &sms.Sender, &sms.Body, &sms.Device, &sms.SentAt, &sms.CreatedAt)
+		messages = append(messages, sms)
+	}
+	return messages, nil
+}
+
 func GetLast7DaysMessageCount() (map[string]int, error) {
 	log.Println("--- GetLast7DaysMessageCount")
 
@@ -304,6 +791,103 @@ func GetLast7DaysMessageCount() (map[string]int, error) {
 	return dayCount, nil
 }
 
+// GetBatchSummary количество сообщений пакета по статусам, по всем каналам
+func GetBatchSummary(batchID string) ([]int, error) {
+	log.Println("--- GetBatchSummary ", batchID)
+
+	rows, err := db.Query(`SELECT status, COUNT(id) as messagecount
+    FROM messages WHERE batch_id = ? GROUP BY status ORDER BY status`, batchID)
+	if err != nil {
+		log.Println("GetBatchSummary: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var status, count int
+	batchSummary := make([]int, smsStatusCount)
+	for rows.Next() {
+		rows.Scan(&status, &count)
+		if status >= 0 && status < smsStatusCount {
+			batchSummary[status] = count
+		}
+	}
+	return batchSummary, nil
+}
+
+// SetGroupMembers заменяет состав именованной группы получателей
+func SetGroupMembers(name string, users []*User) error {
+	log.Println("--- SetGroupMembers ", name, len(users))
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("SetGroupMembers: ", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("DELETE FROM usr_groups WHERE name = ?", name); err != nil {
+		log.Println("SetGroupMembers: ", err)
+		return err
+	}
+	for _, user := range users {
+		if _, err = tx.Exec("INSERT INTO usr_groups(name, fk_usr) VALUES(?, ?)", name, user.ID); err != nil {
+			log.Println("SetGroupMembers: ", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetGroupMembers получатели именованной группы
+func GetGroupMembers(name string) ([]*User, error) {
+	log.Println("--- GetGroupMembers ", name)
+
+	rows, err := db.Query(`SELECT usr.id, usr.phone_number, COALESCE(usr.chat_id_telegram, ''), COALESCE(usr.route, ''), COALESCE(usr.timezone, '')
+    FROM usr_groups JOIN usr ON usr.id = usr_groups.fk_usr WHERE usr_groups.name = ? ORDER BY usr_groups.id`, name)
+	if err != nil {
+		log.Println("GetGroupMembers: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		user := &User{}
+		if err = rows.Scan(&user.ID, &user.PhoneNumber, &user.ChatIdTelegram, &user.Route, &user.Timezone); err != nil {
+			log.Println("GetGroupMembers: ", err)
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// GetChannelSummary количество сообщений по статусам отдельно для каждого канала
+func GetChannelSummary() (map[string][]int, error) {
+	log.Println("--- GetChannelSummary")
+
+	rows, err := db.Query(`SELECT channel, status, COUNT(id) as messagecount
+    FROM messages GROUP BY channel, status ORDER BY channel, status`)
+	if err != nil {
+		log.Println("GetChannelSummary: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channel string
+	var status, count int
+	channelSummary := make(map[string][]int)
+	for rows.Next() {
+		rows.Scan(&channel, &status, &count)
+		if channelSummary[channel] == nil {
+			channelSummary[channel] = make([]int, smsStatusCount)
+		}
+		if status >= 0 && status < smsStatusCount {
+			channelSummary[channel][status] = count
+		}
+	}
+	return channelSummary, nil
+}
+
 func GetStatusSummary() ([]int, error) {
 	log.Println("--- GetStatusSummary")
 
@@ -316,10 +900,12 @@ func GetStatusSummary() ([]int, error) {
 	defer rows.Close()
 
 	var status, count int
-	statusSummary := make([]int, 3)
+	statusSummary := make([]int, smsStatusCount)
 	for rows.Next() {
 		rows.Scan(&status, &count)
-		statusSummary[status] = count
+		if status >= 0 && status < smsStatusCount {
+			statusSummary[status] = count
+		}
 	}
 	rows.Close()
 	return statusSummary, nil
@@ -0,0 +1,292 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gosms/transport"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrTimeout модем не дал окончательного ответа за отведенное время
+var ErrTimeout = errors.New("modem: timed out waiting for answer")
+
+// ErrPortClosed порт модема закрыт или еще не открыт
+var ErrPortClosed = errors.New("modem: port is closed")
+
+// ErrCommand простой ERROR без кода, например на неподдерживаемую команду
+var ErrCommand = errors.New("modem: ERROR")
+
+// ErrInvalidNumber номер получателя пустой, отправлять некому
+var ErrInvalidNumber = transport.Permanent(errors.New("modem: invalid recipient number"))
+
+// CMSError ошибка сервиса сообщений, +CMS ERROR: <err> (3GPP 27.005 3.2.5)
+type CMSError struct {
+	Code int
+	// Text текст ошибки, если модем настроен на текстовые ответы (AT+CMEE=2), Code тогда -1
+	Text string
+}
+
+func (e *CMSError) Error() string {
+	if e.Code < 0 {
+		return "+CMS ERROR: " + e.Text
+	}
+	return fmt.Sprintf("+CMS ERROR: %d %s", e.Code, e.Description())
+}
+
+// Description расшифровка кода по 27.005, 24.011 и 23.040
+func (e *CMSError) Description() string {
+	if e.Text != "" {
+		return e.Text
+	}
+	if description, ok := cmsDescriptions[e.Code]; ok {
+		return description
+	}
+	return "unknown error"
+}
+
+// Permanent ошибка относится к самому сообщению или получателю, а не к сети
+func (e *CMSError) Permanent() bool {
+	return PermanentCMSError(e.Code)
+}
+
+// CMEError ошибка мобильного устройства, +CME ERROR: <err> (3GPP 27.007 9.2)
+type CMEError struct {
+	Code int
+	// Text текст ошибки, если модем настроен на текстовые ответы (AT+CMEE=2), Code тогда -1
+	Text string
+}
+
+func (e *CMEError) Error() string {
+	if e.Code < 0 {
+		return "+CME ERROR: " + e.Text
+	}
+	return fmt.Sprintf("+CME ERROR: %d %s", e.Code, e.Description())
+}
+
+// Description расшифровка кода по 27.007
+func (e *CMEError) Description() string {
+	if e.Text != "" {
+		return e.Text
+	}
+	if description, ok := cmeDescriptions[e.Code]; ok {
+		return description
+	}
+	return "unknown error"
+}
+
+// ответ считается полученным только целой строкой, иначе код может прийти не весь
+var finalError = regexp.MustCompile(`\+(CMS|CME) ERROR: *([^\r\n]*)\r`)
+var plainError = regexp.MustCompile(`(^|\n)` + errorAnswer + `\r`)
+
+// answerError ошибка из ответа модема, nil если ответ ее не содержит
+func answerError(output string) error {
+	match := finalError.FindStringSubmatch(output)
+	if match == nil {
+		if plainError.MatchString(output) {
+			return ErrCommand
+		}
+		return nil
+	}
+	detail := strings.TrimSpace(match[2])
+	code, err := strconv.Atoi(detail)
+	text := ""
+	if err != nil {
+		code, text = -1, detail
+	}
+	if match[1] == "CMS" {
+		return &CMSError{Code: code, Text: text}
+	}
+	return &CMEError{Code: code, Text: text}
+}
+
+// errorCode код +CMS или +CME ERROR, 0 для остальных ошибок
+func errorCode(err error) int {
+	switch err := err.(type) {
+	case *CMSError:
+		return err.Code
+	case *CMEError:
+		return err.Code
+	}
+	return 0
+}
+
+// portError приводит ошибку закрытого порта к ErrPortClosed
+func portError(err error) error {
+	if err == ErrSimulatorClosed || errors.Is(err, os.ErrClosed) {
+		return ErrPortClosed
+	}
+	return err
+}
+
+// answerStatus статус части по ответу модема: OK, Error или пустой, если ответа не было
+// и неизвестно, ушло ли сообщение
+func answerStatus(err error) string {
+	switch err {
+	case nil:
+		return SMSStatusOk
+	case ErrTimeout, context.Canceled, context.DeadlineExceeded:
+		return ""
+	}
+	return SMSStatusError
+}
+
+// permanentCMSErrors коды +CMS ERROR, при которых повторная отправка того же
+// сообщения не поможет. Остальные, например 331 нет сети или 332 таймаут сети,
+// считаются временными
+var permanentCMSErrors = map[int]bool{
+	1:   true,
+	8:   true,
+	10:  true,
+	21:  true,
+	29:  true,
+	30:  true,
+	50:  true,
+	69:  true,
+	96:  true,
+	97:  true,
+	99:  true,
+	193: true,
+	195: true,
+	196: true,
+	304: true,
+	305: true,
+}
+
+// PermanentCMSError повторять отправку после такой ошибки бессмысленно
+func PermanentCMSError(code int) bool {
+	// 128-191: TP-PID, TP-DCS и ошибки команды, сообщение отвергнуто SMSC как есть
+	return permanentCMSErrors[code] || (code >= 128 && code <= 191)
+}
+
+var cmsDescriptions = map[int]string{
+	1:   "unassigned (unallocated) number",
+	8:   "operator determined barring",
+	10:  "call barred",
+	21:  "short message transfer rejected",
+	27:  "destination out of service",
+	28:  "unidentified subscriber",
+	29:  "facility rejected",
+	30:  "unknown subscriber",
+	38:  "network out of order",
+	41:  "temporary failure",
+	42:  "congestion",
+	47:  "resources unavailable, unspecified",
+	50:  "requested facility not subscribed",
+	69:  "requested facility not implemented",
+	81:  "invalid short message transfer reference value",
+	95:  "invalid message, unspecified",
+	96:  "invalid mandatory information",
+	97:  "message type non-existent or not implemented",
+	98:  "message not compatible with short message protocol state",
+	99:  "information element non-existent or not implemented",
+	111: "protocol error, unspecified",
+	127: "interworking, unspecified",
+	128: "telematic interworking not supported",
+	129: "short message type 0 not supported",
+	130: "cannot replace short message",
+	143: "unspecified TP-PID error",
+	144: "data coding scheme (alphabet) not supported",
+	145: "message class not supported",
+	159: "unspecified TP-DCS error",
+	160: "command cannot be actioned",
+	161: "command unsupported",
+	175: "unspecified TP-Command error",
+	176: "TPDU not supported",
+	192: "SC busy",
+	193: "no SC subscription",
+	194: "SC system failure",
+	195: "invalid SME address",
+	196: "destination SME barred",
+	197: "SM rejected-duplicate SM",
+	198: "TP-VPF not supported",
+	199: "TP-VP not supported",
+	208: "SIM SMS storage full",
+	209: "no SMS storage capability in SIM",
+	210: "error in MS",
+	211: "memory capacity exceeded",
+	212: "SIM application toolkit busy",
+	213: "SIM data download error",
+	255: "unspecified error cause",
+	300: "ME failure",
+	301: "SMS service of ME reserved",
+	302: "operation not allowed",
+	303: "operation not supported",
+	304: "invalid PDU mode parameter",
+	305: "invalid text mode parameter",
+	310: "SIM not inserted",
+	311: "SIM PIN required",
+	312: "PH-SIM PIN required",
+	313: "SIM failure",
+	314: "SIM busy",
+	315: "SIM wrong",
+	316: "SIM PUK required",
+	317: "SIM PIN2 required",
+	318: "SIM PUK2 required",
+	320: "memory failure",
+	321: "invalid memory index",
+	322: "memory full",
+	330: "SMSC address unknown",
+	331: "no network service",
+	332: "network timeout",
+	340: "no +CNMA acknowledgement expected",
+	500: "unknown error",
+}
+
+var cmeDescriptions = map[int]string{
+	0:   "phone failure",
+	1:   "no connection to phone",
+	2:   "phone-adaptor link reserved",
+	3:   "operation not allowed",
+	4:   "operation not supported",
+	5:   "PH-SIM PIN required",
+	6:   "PH-FSIM PIN required",
+	7:   "PH-FSIM PUK required",
+	10:  "SIM not inserted",
+	11:  "SIM PIN required",
+	12:  "SIM PUK required",
+	13:  "SIM failure",
+	14:  "SIM busy",
+	15:  "SIM wrong",
+	16:  "incorrect password",
+	17:  "SIM PIN2 required",
+	18:  "SIM PUK2 required",
+	20:  "memory full",
+	21:  "invalid index",
+	22:  "not found",
+	23:  "memory failure",
+	24:  "text string too long",
+	25:  "invalid characters in text string",
+	26:  "dial string too long",
+	27:  "invalid characters in dial string",
+	30:  "no network service",
+	31:  "network timeout",
+	32:  "network not allowed - emergency calls only",
+	40:  "network personalization PIN required",
+	41:  "network personalization PUK required",
+	42:  "network subset personalization PIN required",
+	43:  "network subset personalization PUK required",
+	44:  "service provider personalization PIN required",
+	45:  "service provider personalization PUK required",
+	46:  "corporate personalization PIN required",
+	47:  "corporate personalization PUK required",
+	48:  "hidden key required",
+	49:  "EAP method not supported",
+	50:  "incorrect parameters",
+	100: "unknown",
+	103: "illegal MS",
+	106: "illegal ME",
+	107: "GPRS services not allowed",
+	111: "PLMN not allowed",
+	112: "location area not allowed",
+	113: "roaming not allowed in this location area",
+	132: "service option not supported",
+	133: "requested service option not subscribed",
+	134: "service option temporarily out of order",
+	148: "unspecified GPRS error",
+	149: "PDP authentication failure",
+	150: "invalid mobile class",
+}
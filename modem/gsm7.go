@@ -0,0 +1,126 @@
+package modem
+
+// escapeGSM7 переход в таблицу расширения GSM 03.38
+const escapeGSM7 = 0x1B
+
+// gsm7Alphabet основная таблица GSM 03.38, индекс равен коду септета
+var gsm7Alphabet = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// gsm7Extension таблица расширения GSM 03.38, кодируется через ESC
+var gsm7Extension = map[rune]byte{
+	'\f': 0x0A,
+	'^':  0x14,
+	'{':  0x28,
+	'}':  0x29,
+	'\\': 0x2F,
+	'[':  0x3C,
+	'~':  0x3D,
+	']':  0x3E,
+	'|':  0x40,
+	'€':  0x65,
+}
+
+var gsm7Index = func() map[rune]byte {
+	index := make(map[rune]byte, len(gsm7Alphabet))
+	for i, r := range gsm7Alphabet {
+		if i != escapeGSM7 {
+			index[r] = byte(i)
+		}
+	}
+	return index
+}()
+
+// encodeGSM7 переводит текст в септеты, ok = false если есть непредставимые символы
+func encodeGSM7(message string) (septets []byte, ok bool) {
+	for _, r := range message {
+		if c, found := gsm7Index[r]; found {
+			septets = append(septets, c)
+		} else if c, found := gsm7Extension[r]; found {
+			septets = append(septets, escapeGSM7, c)
+		} else {
+			return nil, false
+		}
+	}
+	return septets, true
+}
+
+// packSeptets упаковывает септеты в октеты, fill - число бит выравнивания после UDH
+func packSeptets(septets []byte, fill int) []byte {
+	packed := make([]byte, (len(septets)*7+fill+7)/8)
+	bit := fill
+	for _, s := range septets {
+		for i := 0; i < 7; i++ {
+			if s&(1<<uint(i)) != 0 {
+				packed[bit/8] |= 1 << uint(bit%8)
+			}
+			bit++
+		}
+	}
+	return packed
+}
+
+// splitGSM7 разбивает септеты на части, не разрывая ESC-последовательности
+func splitGSM7(septets []byte, ref16 bool) [][]byte {
+	if len(septets) <= maxUserDataOctets*8/7 {
+		return [][]byte{septets}
+	}
+
+	perPart := (maxUserDataOctets - udhLength(ref16)) * 8 / 7
+	var parts [][]byte
+	for len(septets) > 0 {
+		n := perPart
+		if n >= len(septets) {
+			n = len(septets)
+		} else if septets[n-1] == escapeGSM7 {
+			n--
+		}
+		parts = append(parts, septets[:n])
+		septets = septets[n:]
+	}
+	return parts
+}
+
+// unpackSeptets распаковывает count септетов, пропуская fill бит выравнивания
+func unpackSeptets(data []byte, count, fill int) []byte {
+	septets := make([]byte, 0, count)
+	bit := fill
+	for i := 0; i < count && bit+7 <= len(data)*8; i++ {
+		var s byte
+		for j := 0; j < 7; j++ {
+			if data[bit/8]&(1<<uint(bit%8)) != 0 {
+				s |= 1 << uint(j)
+			}
+			bit++
+		}
+		septets = append(septets, s)
+	}
+	return septets
+}
+
+// decodeGSM7 переводит септеты в текст с учетом таблицы расширения
+func decodeGSM7(septets []byte) string {
+	runes := make([]rune, 0, len(septets))
+	for i := 0; i < len(septets); i++ {
+		c := septets[i]
+		if c == escapeGSM7 && i+1 < len(septets) {
+			i++
+			if r, ok := gsm7ExtensionIndex[septets[i]]; ok {
+				runes = append(runes, r)
+			} else {
+				runes = append(runes, gsm7Alphabet[septets[i]&0x7F])
+			}
+			continue
+		}
+		runes = append(runes, gsm7Alphabet[c&0x7F])
+	}
+	return string(runes)
+}
+
+var gsm7ExtensionIndex = func() map[byte]rune {
+	index := make(map[byte]rune, len(gsm7Extension))
+	for r, c := range gsm7Extension {
+		index[c] = r
+	}
+	return index
+}()
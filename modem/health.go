@@ -0,0 +1,107 @@
+package modem
+
+import (
+	"fmt"
+	"gosms/transport"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var cpinAnswer = regexp.MustCompile(`\+CPIN:\s*([^\r\n]+)`)
+var cregAnswer = regexp.MustCompile(`\+CREG:\s*\d+\s*,\s*(\d+)`)
+var csqAnswer = regexp.MustCompile(`\+CSQ:\s*(\d+)\s*,\s*(\d+)`)
+
+// Probe проверяет, что модем отвечает, SIM разблокирована, модем зарегистрирован
+// в сети и есть сигнал (AT, AT+CPIN?, AT+CREG?, AT+CSQ). Результат доступен через Health
+func (m *GSMModem) Probe() error {
+	m.session.Lock()
+	err := m.probe()
+	m.session.Unlock()
+	if err != nil {
+		log.Println("Probe: ", m.DeviceId, err)
+		m.setHealth(transport.Health{Healthy: false, Reason: err.Error()})
+		return err
+	}
+	m.setHealth(transport.Health{Healthy: true})
+	return nil
+}
+
+// simState состояние SIM из ответа AT+CPIN?: READY, SIM PIN, SIM PUK...
+func simState(output string) string {
+	pin := cpinAnswer.FindStringSubmatch(output)
+	if pin == nil {
+		return "unexpected AT+CPIN? answer: " + strings.TrimSpace(output)
+	}
+	return strings.TrimSpace(pin[1])
+}
+
+func (m *GSMModem) probe() error {
+	if _, err := m.command("AT\r"); err != nil {
+		return err
+	}
+
+	output, err := m.command("AT+CPIN?\r")
+	if err != nil {
+		return err
+	}
+	if state := simState(output); state != "READY" {
+		return fmt.Errorf("SIM is not ready: %s", state)
+	}
+
+	output, err = m.command("AT+CREG?\r")
+	if err != nil {
+		return err
+	}
+	match := cregAnswer.FindStringSubmatch(output)
+	if match == nil {
+		return fmt.Errorf("unexpected AT+CREG? answer: %s", strings.TrimSpace(output))
+	}
+	m.recordRegistration(match[1])
+	// 1 - домашняя сеть, 5 - роуминг
+	if stat := match[1]; stat != "1" && stat != "5" {
+		return fmt.Errorf("not registered in network, +CREG stat %s", stat)
+	}
+
+	output, err = m.command("AT+CSQ\r")
+	if err != nil {
+		return err
+	}
+	signal := csqAnswer.FindStringSubmatch(output)
+	if signal == nil {
+		return fmt.Errorf("unexpected AT+CSQ answer: %s", strings.TrimSpace(output))
+	}
+	rssi, _ := strconv.Atoi(signal[1])
+	ber, _ := strconv.Atoi(signal[2])
+	m.recordSignal(rssi, ber)
+	if rssi == 99 {
+		return fmt.Errorf("no signal")
+	}
+	return nil
+}
+
+// Reconnect закрывает порт и подключается заново, например после отключения USB модема
+func (m *GSMModem) Reconnect() error {
+	m.Close()
+	if err := m.Connect(); err != nil {
+		return err
+	}
+	return m.Probe()
+}
+
+// Health последнее известное состояние модема, реализует transport.Transport
+func (m *GSMModem) Health() transport.Health {
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	if !m.health.Healthy && m.health.Reason == "" {
+		return transport.Health{Healthy: false, Reason: "not connected"}
+	}
+	return m.health
+}
+
+func (m *GSMModem) setHealth(health transport.Health) {
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	m.health = health
+}
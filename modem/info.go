@@ -0,0 +1,196 @@
+package modem
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signalHistorySize сколько последних замеров сигнала хранить
+const signalHistorySize = 60
+
+// SignalSample замер уровня сигнала
+type SignalSample struct {
+	At   time.Time `json:"at"`
+	RSSI int       `json:"rssi"` // 0-31 из AT+CSQ, 99 - неизвестен
+	DBm  int       `json:"dbm"`  // 0 если неизвестен
+}
+
+// DeviceInfo сведения о модеме и SIM, обновляются при каждой проверке
+type DeviceInfo struct {
+	// Manufacturer ответ AT+CGMI или ATI, Vendor производитель, чьи команды использованы при подключении
+	Manufacturer string       `json:"manufacturer"`
+	Vendor       string       `json:"vendor"`
+	Signal       SignalSample `json:"signal"`
+	BER          int          `json:"ber"`
+	Operator     string       `json:"operator"`
+	Registration string       `json:"registration"`
+	IMEI         string       `json:"imei"`
+	IMSI         string       `json:"imsi"`
+	ICCID        string       `json:"iccid"`
+	Number       string       `json:"number"`
+	// BatteryLevel заряд в процентах из AT+CBC, Temperature из AT+CMTE?, nil если модем не поддерживает
+	BatteryLevel  *int           `json:"battery_level"`
+	Temperature   *int           `json:"temperature"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	SignalHistory []SignalSample `json:"signal_history"`
+}
+
+// registrationStates значения <stat> из AT+CREG? (3GPP 27.007 7.2)
+var registrationStates = map[string]string{
+	"0": "not registered",
+	"1": "home",
+	"2": "searching",
+	"3": "denied",
+	"4": "unknown",
+	"5": "roaming",
+}
+
+var copsAnswer = regexp.MustCompile(`\+COPS:\s*\d+\s*,\s*\d+\s*,\s*"([^"]*)"`)
+var cnumAnswer = regexp.MustCompile(`\+CNUM:\s*"[^"]*"\s*,\s*"([^"]+)"`)
+var cbcAnswer = regexp.MustCompile(`\+CBC:\s*\d+\s*,\s*(\d+)`)
+var cmteAnswer = regexp.MustCompile(`\+CMTE:\s*\d+\s*,\s*(-?\d+)`)
+var ccidAnswer = regexp.MustCompile(`([0-9]{18,20}[0-9Ff]?)`)
+var digitsAnswer = regexp.MustCompile(`(?m)^\s*(\d{6,})\s*$`)
+
+// rssiDBm переводит <rssi> из AT+CSQ в дБм
+func rssiDBm(rssi int) int {
+	if rssi < 0 || rssi > 31 {
+		return 0
+	}
+	return -113 + 2*rssi
+}
+
+// Info сведения, собранные последними Probe и RefreshInfo
+func (m *GSMModem) Info() DeviceInfo {
+	m.infoMu.Lock()
+	defer m.infoMu.Unlock()
+	info := m.info
+	info.SignalHistory = append([]SignalSample(nil), m.info.SignalHistory...)
+	return info
+}
+
+func (m *GSMModem) recordSignal(rssi, ber int) {
+	m.infoMu.Lock()
+	defer m.infoMu.Unlock()
+	sample := SignalSample{At: time.Now(), RSSI: rssi, DBm: rssiDBm(rssi)}
+	m.info.Signal = sample
+	m.info.BER = ber
+	m.info.UpdatedAt = sample.At
+	m.info.SignalHistory = append(m.info.SignalHistory, sample)
+	if len(m.info.SignalHistory) > signalHistorySize {
+		m.info.SignalHistory = m.info.SignalHistory[len(m.info.SignalHistory)-signalHistorySize:]
+	}
+}
+
+func (m *GSMModem) recordRegistration(stat string) {
+	m.infoMu.Lock()
+	defer m.infoMu.Unlock()
+	if state, ok := registrationStates[stat]; ok {
+		m.info.Registration = state
+	} else {
+		m.info.Registration = "unknown"
+	}
+}
+
+func (m *GSMModem) recordVendor(manufacturer, vendor string) {
+	m.infoMu.Lock()
+	defer m.infoMu.Unlock()
+	m.info.Manufacturer, m.info.Vendor = manufacturer, vendor
+}
+
+// resetIdentity забывает IMEI, IMSI, ICCID и номер: после переподключения SIM может быть другой
+func (m *GSMModem) resetIdentity() {
+	m.infoMu.Lock()
+	defer m.infoMu.Unlock()
+	m.info.IMEI, m.info.IMSI, m.info.ICCID, m.info.Number = "", "", "", ""
+}
+
+// RefreshInfo запрашивает оператора (AT+COPS?), заряд (AT+CBC), температуру (AT+CMTE?),
+// а также IMEI, IMSI, ICCID и номер, если они еще не известны. Команды, которые модем
+// не поддерживает, пропускаются; ошибка возвращается, только если модем недоступен
+func (m *GSMModem) RefreshInfo() error {
+	m.session.Lock()
+	defer m.session.Unlock()
+	info := m.Info()
+	query := func(command string) (string, bool, error) {
+		output, err := m.command(command)
+		if err == ErrPortClosed || err == ErrTimeout {
+			return "", false, err
+		}
+		if err != nil {
+			log.Println("RefreshInfo: ", m.DeviceId, strings.TrimSpace(command), err)
+			return "", false, nil
+		}
+		return output, true, nil
+	}
+
+	output, ok, err := query("AT+COPS?\r")
+	if err != nil {
+		return err
+	}
+	if match := copsAnswer.FindStringSubmatch(output); ok && match != nil {
+		info.Operator = match[1]
+	}
+
+	if info.IMEI == "" {
+		if output, ok, err = query("AT+CGSN\r"); err != nil {
+			return err
+		}
+		if match := digitsAnswer.FindStringSubmatch(output); ok && match != nil {
+			info.IMEI = match[1]
+		}
+	}
+	if info.IMSI == "" {
+		if output, ok, err = query("AT+CIMI\r"); err != nil {
+			return err
+		}
+		if match := digitsAnswer.FindStringSubmatch(output); ok && match != nil {
+			info.IMSI = match[1]
+		}
+	}
+	if info.ICCID == "" {
+		if output, ok, err = query("AT+CCID\r"); err != nil {
+			return err
+		}
+		if match := ccidAnswer.FindStringSubmatch(output); ok && match != nil {
+			info.ICCID = match[1]
+		}
+	}
+	if info.Number == "" {
+		if output, ok, err = query("AT+CNUM\r"); err != nil {
+			return err
+		}
+		if match := cnumAnswer.FindStringSubmatch(output); ok && match != nil {
+			info.Number = match[1]
+		}
+	}
+
+	if output, ok, err = query("AT+CBC\r"); err != nil {
+		return err
+	}
+	info.BatteryLevel = nil
+	if match := cbcAnswer.FindStringSubmatch(output); ok && match != nil {
+		level, _ := strconv.Atoi(match[1])
+		info.BatteryLevel = &level
+	}
+	if output, ok, err = query("AT+CMTE?\r"); err != nil {
+		return err
+	}
+	info.Temperature = nil
+	if match := cmteAnswer.FindStringSubmatch(output); ok && match != nil {
+		temperature, _ := strconv.Atoi(match[1])
+		info.Temperature = &temperature
+	}
+
+	m.infoMu.Lock()
+	defer m.infoMu.Unlock()
+	m.info.Operator = info.Operator
+	m.info.IMEI, m.info.IMSI, m.info.ICCID, m.info.Number = info.IMEI, info.IMSI, info.ICCID, info.Number
+	m.info.BatteryLevel = info.BatteryLevel
+	m.info.Temperature = info.Temperature
+	m.info.UpdatedAt = time.Now()
+	return nil
+}
@@ -1,131 +1,517 @@
 package modem
 
 import (
-	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"github.com/tarm/serial"
+	"gosms/transport"
+	"io"
 	"log"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	"unicode/utf16"
 )
-var lock sync.Mutex
-const waitReps int = 5
+// CommandTimeout сколько ждать окончательного ответа на команду, если для нее нет своего в commandTimeouts
+var CommandTimeout = 5 * time.Second
+
+// SubmitTimeout сколько ждать +CMGS после передачи PDU, SMSC загруженной сети отвечает до минуты
+var SubmitTimeout = 60 * time.Second
+
+// commandTimeouts команды, которым обычно не хватает CommandTimeout
+var commandTimeouts = map[string]time.Duration{
+	"AT+CMGS":  15 * time.Second, // приглашение "> "
+	"AT+CMGL":  30 * time.Second, // длинный список сообщений
+	"AT+CPIN=": 15 * time.Second,
+	"AT+CUSD=": 15 * time.Second, // только OK, ответ сети ждет USSDTimeout
+	"AT+COPS=": 3 * time.Minute,  // ручной выбор сети
+}
+
+// timeoutFor таймаут команды по ее началу
+func timeoutFor(command string) time.Duration {
+	command = strings.ToUpper(command)
+	for prefix, timeout := range commandTimeouts {
+		if strings.HasPrefix(command, prefix) && timeout > CommandTimeout {
+			return timeout
+		}
+	}
+	return CommandTimeout
+}
 // ответы получаемые от модема
 const (
 	SMSStatusOk = "OK"
 	SMSStatusError = "Error"
+	// errorAnswer так модем сообщает об ошибке: ERROR, +CMS ERROR: <n>, +CME ERROR: <n>
+	errorAnswer = "ERROR"
 )
+// Port соединение с модемом: последовательный порт или Simulator
+type Port interface {
+	io.ReadWriter
+	Flush() error
+	Close() error
+}
+
 type GSMModem struct {
+	// session одна транзакция с модемом за раз: команда и ответ, USSD запрос и ответ сети,
+	// отправка всех частей сообщения. exchange, command, sendRaw и readAnswer вызываются под ним
+	session sync.Mutex
+	// reader читает порт текущего подключения, nil пока порт закрыт
+	reader *lineReader
+	// live тот же читатель для Close: закрыть порт можно, не дожидаясь session
+	liveMu sync.Mutex
+	live   *lineReader
+	// current последняя отправленная команда, по ней читатель отличает ответ от уведомления
+	current atomic.Value
+	subscribers subscribers
+
 	ComPort  string
 	BaudRate int
-	Port     *serial.Port
+	Port     Port
 	DeviceId string
+	// ConcatRef16 использовать 16-битную ссылку в UDH составных сообщений
+	ConcatRef16 bool
+	// StatusReport запрашивать отчеты о доставке (TP-SRR)
+	StatusReport bool
+	// PIN код SIM, вводится при подключении, если SIM его запрашивает
+	PIN string
+	// SMSC номер центра сообщений для AT+CSCA, пустой - номер, записанный на SIM
+	SMSC string
+	// Storage память сообщений для AT+CPMS, например SM или SM,SM,ME; пустой - по производителю
+	Storage string
+	// InitCommands дополнительные команды, выполняются последними при каждом подключении
+	InitCommands []string
+	// Vendor производитель (VendorHuawei...), пустой - определяется через AT+CGMI или ATI
+	Vendor string
+
+	concatRef uint16
+	// pinRejected SIM не приняла PIN, повторный ввод того же кода приведет к блокировке PUK
+	pinRejected bool
+	incoming  chan bool
+	openPort  func() (Port, error)
+	// отчеты, пришедшие через +CDS, отдаются вместе с ReadMessages
+	reportsMu sync.Mutex
+	reports   []*StatusReport
+	// health результат последнего Probe
+	healthMu sync.Mutex
+	health   transport.Health
+	// info сведения об устройстве и SIM, см. Info
+	infoMu sync.Mutex
+	info   DeviceInfo
+}
+
+// InboundSMS входящее сообщение, собранное из одной или нескольких частей
+type InboundSMS struct {
+	Sender    string
+	Timestamp time.Time
+	Body      string
+	Indexes   []int // ячейки памяти, которые занимают части сообщения
+}
+
+// PartResult результат отправки одной части сообщения
+type PartResult struct {
+	Part      int    `json:"part"`
+	Status    string `json:"status"`
+	Reference int    `json:"reference"` // TP-MR из +CMGS, -1 если модем его не вернул
+	Code      int    `json:"code"`      // код +CMS или +CME ERROR, 0 если его не было
+	Err       error  `json:"-"`         // ошибка модема, nil если часть отправлена
+}
+
+// SendResult результат отправки всех частей одного сообщения
+type SendResult struct {
+	Parts []PartResult `json:"parts"`
+}
+
+// Status общий статус сообщения: OK только если отправлены все части
+func (r SendResult) Status() string {
+	if len(r.Parts) == 0 {
+		return SMSStatusError
+	}
+	for _, part := range r.Parts {
+		if part.Status != SMSStatusOk {
+			return part.Status
+		}
+	}
+	return SMSStatusOk
 }
 
+// New создает модем на последовательном порту; ComPort = SimulatorPort создает программный модем
 func New(ComPort string, BaudRate int, DeviceId string) (modem *GSMModem) {
-	modem = &GSMModem{ComPort: ComPort, BaudRate: BaudRate, DeviceId: DeviceId}
+	if ComPort == SimulatorPort {
+		return NewWithPort(DeviceId, NewSimulator())
+	}
+	modem = &GSMModem{ComPort: ComPort, BaudRate: BaudRate, DeviceId: DeviceId, incoming: make(chan bool, 1)}
+	modem.openPort = modem.openSerial
 	return modem
 }
 
-func (m *GSMModem) Connect() (err error) {
+// NewWithPort создает модем поверх готового соединения, например Simulator
+func NewWithPort(DeviceId string, port Port) (modem *GSMModem) {
+	modem = &GSMModem{DeviceId: DeviceId, incoming: make(chan bool, 1)}
+	modem.openPort = func() (Port, error) {
+		if simulator, ok := port.(*Simulator); ok {
+			simulator.reopen()
+		}
+		return port, nil
+	}
+	return modem
+}
+
+func (m *GSMModem) openSerial() (Port, error) {
 	config := &serial.Config{Name: m.ComPort, Baud: m.BaudRate, ReadTimeout: time.Second}
-	m.Port, err = serial.OpenPort(config)
+	port, err := serial.OpenPort(config)
+	if err != nil {
+		return nil, err
+	}
+	return port, nil
+}
+
+func (m *GSMModem) Connect() (err error) {
+	m.session.Lock()
+	defer m.session.Unlock()
+	m.Port, err = m.openPort()
 
 	if err == nil {
-		m.initModem()
+		m.reader = m.startReader(m.Port)
+		m.liveMu.Lock()
+		m.live = m.reader
+		m.liveMu.Unlock()
+		m.resetIdentity()
+		err = m.initModem()
+	}
+	if err == nil {
+		m.setHealth(transport.Health{Healthy: true})
+	} else {
+		m.setHealth(transport.Health{Healthy: false, Reason: err.Error()})
 	}
 
 	return err
 }
 
-func (m *GSMModem) initModem() {
-	m.SendCommand("ATE0\r\n", true) // echo off
-	m.SendCommand("AT+CMEE=1\r\n", true) // useful error messages
-	m.SendCommand("AT+WIND=0\r\n", true) // disable notifications
+// initModem ошибка возвращается, только если модем недоступен или SIM не разблокирована,
+// команды, которые модем не поддерживает, пропускаются
+func (m *GSMModem) initModem() error {
+	m.command("ATE0\r") // echo off
+	m.command("AT+CMEE=1\r") // useful error messages
+	vendor := m.identifyVendor()
+	if err := m.unlockSIM(); err != nil {
+		return err
+	}
+
+	profile := vendorProfiles[vendor]
+	commands := append([]string(nil), profile.InitCommands...)
+	if m.SMSC != "" {
+		commands = append(commands, smscCommand(m.SMSC))
+	}
+	storage := m.Storage
+	if storage == "" {
+		storage = profile.Storage
+	}
+	if storage != "" {
+		commands = append(commands, storageCommand(storage))
+	}
+	// входящие SMS и отчеты о доставке сохраняются в памяти, уведомление через +CMTI/+CDSI
+	commands = append(commands, "AT+CNMI=2,1,0,2,0")
+	commands = append(commands, m.InitCommands...)
+
+	for _, command := range commands {
+		if _, err := m.command(command + "\r"); err == ErrPortClosed {
+			return err
+		} else if err != nil {
+			log.Println("initModem: ", m.DeviceId, command, err)
+		}
+	}
+	return nil
+}
+
+// identifyVendor запоминает ответ AT+CGMI (или ATI) и возвращает производителя,
+// заданный в конфигурации или определенный по этому ответу
+func (m *GSMModem) identifyVendor() string {
+	output, err := m.command("AT+CGMI\r")
+	if err != nil {
+		output, err = m.command("ATI\r")
+	}
+	manufacturer := ""
+	if err == nil {
+		manufacturer = answerText(output)
+	}
+	vendor := m.Vendor
+	if vendor == VendorUnknown {
+		vendor = detectVendor(manufacturer)
+	}
+	log.Printf("identifyVendor: %s manufacturer %q vendor %q", m.DeviceId, manufacturer, vendor)
+	m.recordVendor(manufacturer, vendor)
+	return vendor
+}
+
+// pinAttempts сколько раз ждать готовности SIM после ввода PIN
+const pinAttempts = 10
+
+// unlockSIM вводит PIN, если SIM его запрашивает, и ждет, пока она будет готова
+func (m *GSMModem) unlockSIM() error {
+	output, err := m.command("AT+CPIN?\r")
+	if err != nil {
+		return err
+	}
+	state := simState(output)
+	if state == "READY" {
+		return nil
+	}
+	if state != "SIM PIN" {
+		// PUK вводится вручную, иначе можно заблокировать SIM окончательно
+		return fmt.Errorf("SIM is not ready: %s", state)
+	}
+	if m.PIN == "" {
+		return fmt.Errorf("SIM PIN required, set PIN in device config")
+	}
+	if m.pinRejected {
+		return fmt.Errorf("SIM PIN required, configured PIN was rejected")
+	}
+
+	log.Println("unlockSIM: ", m.DeviceId, "entering PIN")
+	if _, err := m.command(fmt.Sprintf("AT+CPIN=\"%s\"\r", m.PIN)); err != nil {
+		// обычно +CME ERROR: 16 incorrect password, но некоторые модемы отвечают просто ERROR
+		if err != ErrTimeout && err != ErrPortClosed {
+			m.pinRejected = true
+		}
+		return fmt.Errorf("SIM rejected PIN: %v", err)
+	}
+	// SIM отвечает SIM busy или еще не готова сразу после ввода PIN
+	for i := 0; i < pinAttempts; i++ {
+		if output, err = m.command("AT+CPIN?\r"); err == nil {
+			if state = simState(output); state == "READY" {
+				return nil
+			}
+		} else if err == ErrPortClosed {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("SIM is not ready after entering PIN: %s", state)
 }
 
+// answerText строки ответа без OK, например "huawei" из ответа AT+CGMI
+func answerText(output string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.Replace(output, "\r", "\n", -1), "\n") {
+		if line = strings.TrimSpace(line); line != "" && line != SMSStatusOk {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, " ")
+}
+
+// Incoming сигнализирует о получении +CMTI, т.е. о новом сообщении в памяти модема
+func (m *GSMModem) Incoming() <-chan bool {
+	return m.incoming
+}
+
+// notifyIncoming не блокируется, если о новом сообщении уже сообщено
+func (m *GSMModem) notifyIncoming() {
+	select {
+	case m.incoming <- true:
+	default:
+	}
+}
+
+// ExpectAnswer ждет окончательного ответа модема. Ошибки: *CMSError, *CMEError,
+// ErrCommand, ErrTimeout, ErrPortClosed
 func (m *GSMModem) ExpectAnswer() (string, error) {
+	m.session.Lock()
+	defer m.session.Unlock()
+	return m.readAnswer(context.Background(), false, CommandTimeout)
+}
 
-	var status string
-	var buffer bytes.Buffer
-	buf := make([]byte, 32)
-	lock.Lock()
-	defer lock.Unlock()
-	for i := 1; i < waitReps+1; {
-		// ignoring error as EOF raises error on Linux
-		n, _ := m.Port.Read(buf)
-		if n > 0 {
-			buffer.Write(buf[:n])
-			status = buffer.String()
-			log.Printf("WaitForOutput: received %d bytes: %#v\n", n, string(buf[:n]))
-			if strings.Contains(status, SMSStatusOk) {
-				return SMSStatusOk, nil
-			} else if strings.Contains(status, SMSStatusError) {
-				errorCodes := regexp.MustCompile(`([A-Z ]*)ERROR([0-9A-Za-z :]*)`).FindAllStringSubmatch(status, -1)
-				if errorCodes[0][1] == "" && errorCodes[0][2] == "" {
-					return status, fmt.Errorf("WaitForOutput: Found unknown ERROR")
-				} else {
-					return status, fmt.Errorf("WaitForOutput: Found %vERROR%v", errorCodes[0][1], errorCodes[0][2])
+// readAnswer собирает строки ответа до окончательного OK, ERROR, +CMS ERROR или +CME ERROR,
+// при prompt также до приглашения "> " для ввода PDU. Если ctx отменен раньше, возвращает ctx.Err()
+func (m *GSMModem) readAnswer(ctx context.Context, prompt bool, timeout time.Duration) (string, error) {
+	if m.reader == nil {
+		return "", ErrPortClosed
+	}
+	var lines []string
+	output := func() string {
+		if len(lines) == 0 {
+			return ""
+		}
+		return strings.Join(lines, "\r\n") + "\r\n"
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case line := <-m.reader.lines:
+			if line == promptLine {
+				if prompt {
+					return output() + promptLine, nil
 				}
+				continue
 			}
-		} else {
-			log.Printf("WaitForOutput: No output on %dth iteration", i)
-			i++
+			lines = append(lines, line)
+			if line == SMSStatusOk {
+				return output(), nil
+			}
+			if err := answerError(line + "\r"); err != nil {
+				log.Printf("readAnswer: %v", err)
+				return output(), err
+			}
+		case <-m.reader.done:
+			return output(), ErrPortClosed
+		case <-timer.C:
+			log.Printf("readAnswer: no answer in %v", timeout)
+			return output(), ErrTimeout
+		case <-ctx.Done():
+			log.Printf("readAnswer: %v", ctx.Err())
+			return output(), ctx.Err()
 		}
 	}
-	return status, errors.New("Error. WaitForOutput: Timed out.")
 }
 
-func (m *GSMModem) Send(command string) {
-	log.Println("--- Send:", m.transposeLog(command))
+func (m *GSMModem) currentCommand() string {
+	command, _ := m.current.Load().(string)
+	return command
+}
+
+// SendRaw пишет команду в порт, не дожидаясь ответа
+func (m *GSMModem) SendRaw(command string) error {
+	m.session.Lock()
+	defer m.session.Unlock()
+	return m.sendRaw(command)
+}
+
+func (m *GSMModem) sendRaw(command string) error {
+	log.Println("--- SendRaw:", m.transposeLog(command))
+	if m.Port == nil || m.reader == nil {
+		return ErrPortClosed
+	}
 	m.Port.Flush()
+	// строки, которые пришли без команды, к ответу на эту не относятся
+	for drained := false; !drained; {
+		select {
+		case line := <-m.reader.lines:
+			log.Println("SendRaw: ", m.DeviceId, "discarding", line)
+		default:
+			drained = true
+		}
+	}
+	m.current.Store(strings.ToUpper(strings.TrimSpace(command)))
 	_, err := m.Port.Write([]byte(command))
 	if err != nil {
-		log.Fatal(err)
+		log.Println("SendRaw: ", err)
+		return portError(err)
+	}
+	return nil
+}
+
+// Command отправляет команду и ждет окончательного ответа, ошибки как у ExpectAnswer
+func (m *GSMModem) Command(command string) (string, error) {
+	return m.CommandContext(context.Background(), command)
+}
+
+// CommandContext как Command, но ждет не дольше, чем позволяет ctx. Новый код использует
+// его вместо SendCommand; ошибки как у ExpectAnswer, а также ctx.Err()
+func (m *GSMModem) CommandContext(ctx context.Context, command string) (string, error) {
+	m.session.Lock()
+	defer m.session.Unlock()
+	return m.exchange(ctx, command, false, timeoutFor(command))
+}
+
+func (m *GSMModem) command(command string) (string, error) {
+	return m.exchange(context.Background(), command, false, timeoutFor(command))
+}
+
+// exchange отправляет команду и ждет ответа не дольше timeout и ctx,
+// при prompt ответом считается и приглашение для ввода PDU
+func (m *GSMModem) exchange(ctx context.Context, command string, prompt bool, timeout time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := m.sendRaw(command); err != nil {
+		return "", err
+	}
+	return m.readAnswer(ctx, prompt, timeout)
+}
+
+// Close закрывает порт, дальнейшие команды вернут ErrPortClosed
+func (m *GSMModem) Close() error {
+	// команда, ждущая ответа, держит session; закрытие порта сразу ее прерывает
+	m.liveMu.Lock()
+	live := m.live
+	m.live = nil
+	m.liveMu.Unlock()
+	var err error
+	if live != nil {
+		err = live.port.Close()
+	}
+
+	m.session.Lock()
+	defer m.session.Unlock()
+	if m.Port == nil {
+		return err
+	}
+	if live == nil || live != m.reader {
+		// подключились уже после того, как live был взят
+		err = m.Port.Close()
+		m.liveMu.Lock()
+		m.live = nil
+		m.liveMu.Unlock()
+	}
+	if m.reader != nil {
+		m.reader.wait()
+		m.reader = nil
 	}
+	m.Port = nil
+	m.setHealth(transport.Health{Healthy: false, Reason: "port closed"})
+	return err
 }
 
 func (m *GSMModem) Read(n int) string {
-	var output string = "";
-	buf := make([]byte, n)
-	for i := 0; i < n; i++ {
-		// ignoring error as EOF raises error on Linux
-		c, _ := m.Port.Read(buf)
-		if c > 0 {
-			output = string(buf[:c])
+	m.session.Lock()
+	defer m.session.Unlock()
+	return m.read(n)
+}
+
+// read строки, полученные за n секунд, без разбора
+func (m *GSMModem) read(n int) string {
+	var lines []string
+	if m.reader != nil {
+		timeout := time.After(time.Duration(n) * time.Second)
+	wait:
+		for {
+			select {
+			case line := <-m.reader.lines:
+				lines = append(lines, line)
+			case <-m.reader.done:
+				break wait
+			case <-timeout:
+				break wait
+			}
 		}
 	}
+	output := strings.Join(lines, "\r\n")
 
 	log.Printf("--- Read(%d): %v", n, m.transposeLog(output))
 	return output
 }
 
+// SendCommand прежний API без ошибок, новый код использует Command
 func (m *GSMModem) SendCommand(command string, waitForOk bool) string {
-	m.Send(command)
-
 	if waitForOk {
-		output, _ := m.ExpectAnswer() // we will not change api so errors are ignored for now
+		output, _ := m.Command(command)
 		return output
 	} else {
-		return m.Read(1)
+		m.session.Lock()
+		defer m.session.Unlock()
+		m.sendRaw(command)
+		return m.read(1)
 	}
 }
 
-// hexUTF16FromString кодирует в USC-2
-func hexUTF16FromString(s string) string {
-	hex := fmt.Sprintf("%04x", utf16.Encode([]rune(s)))
-	return strings.Replace(hex[1:len(hex)-1], " ", "", -1)
-}
-
 // convertMobile кодирует номер в pdu
 func convertMobile(number string) string{
-	if number[0] == '+'{
-		number = number[1:]
+	number = strings.TrimPrefix(number, "+")
+	if number == "" {
+		return ""
 	}
 	if number[0] == '8'{
 		number = "7" + number[1:]
@@ -143,29 +529,238 @@ func convertMobile(number string) string{
 	return strings.Join(numberArray, "")
 }
 
-// convertCountMessage кодирует длину сообщения в pdu
-func convertCountMessage(message string) string{
-	lenMessage := strconv.FormatInt(int64(len([]rune(message))*2), 16)
+// ID идентификатор устройства из конфигурации
+func (m *GSMModem) ID() string {
+	return m.DeviceId
+}
 
-	if len([]rune(lenMessage)) == 1 {
-		lenMessage = "0" + lenMessage
+// Send отправляет сообщение через модем, реализует transport.Transport
+func (m *GSMModem) Send(ctx context.Context, msg transport.Message) (transport.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return transport.Result{Status: transport.StatusFailed}, err
+	}
+	if strings.TrimPrefix(msg.To, "+") == "" {
+		return transport.Result{Status: transport.StatusFailed}, ErrInvalidNumber
 	}
 
-	return lenMessage
+	sent := m.SendSMSContext(ctx, msg.To, msg.Body)
+	result := transport.Result{Status: transportStatus(sent.Status())}
+	for _, part := range sent.Parts {
+		result.Parts = append(result.Parts, transport.Part{Part: part.Part, Status: transportStatus(part.Status), Reference: part.Reference})
+	}
+	if result.Status != transport.StatusSent {
+		for _, part := range sent.Parts {
+			if part.Err == nil {
+				continue
+			}
+			if cms, ok := part.Err.(*CMSError); ok && cms.Permanent() {
+				return result, transport.Permanent(cms)
+			}
+			return result, part.Err
+		}
+		return result, fmt.Errorf("SendSMS: %s", sent.Status())
+	}
+	return result, nil
+}
+
+// transportStatus приводит ответ модема к статусу transport
+func transportStatus(status string) transport.Status {
+	switch status {
+	case SMSStatusOk:
+		return transport.StatusSent
+	case SMSStatusError:
+		return transport.StatusFailed
+	}
+	return transport.StatusUnknown
 }
 
-func (m *GSMModem) SendSMS(mobile string, message string) string {
+var cmgsReference = regexp.MustCompile(`\+CMGS:\s*(\d+)`)
+
+// SendSMS отправляет сообщение, при необходимости разбивая его на части с UDH
+func (m *GSMModem) SendSMS(mobile string, message string) SendResult {
+	return m.SendSMSContext(context.Background(), mobile, message)
+}
+
+// SendSMSContext как SendSMS, но прекращает отправку, когда ctx отменен. Часть, PDU которой
+// уже передан модему, получает неизвестный статус: сообщение могло уйти
+func (m *GSMModem) SendSMSContext(ctx context.Context, mobile string, message string) SendResult {
 	log.Println("--- SendSMS ", mobile, message)
+	// все части одного сообщения подряд, без чужих команд между приглашением и PDU
+	m.session.Lock()
+	defer m.session.Unlock()
+
+	if _, err := m.exchange(ctx, "AT+CMGF=0\r", false, CommandTimeout); err != nil {
+		log.Println("SendSMS: ", err)
+		return SendResult{Parts: []PartResult{{Part: 1, Status: answerStatus(err), Reference: -1, Err: err}}}
+	}
+
+	m.concatRef++
+	segments := buildSubmitPDUs(mobile, message, submitOptions{ref: m.concatRef, ref16: m.ConcatRef16, statusReport: m.StatusReport})
+
+	var result SendResult
+	for i, segment := range segments {
+		command := fmt.Sprintf("AT+CMGS=%d\r", segment.Length)
+		if _, err := m.exchange(ctx, command, true, timeoutFor(command)); err != nil {
+			// отказ до приема PDU, например +CMS ERROR: 331 нет сети
+			log.Printf("SendSMS: part %d/%d rejected: %v", i+1, len(segments), err)
+			if answerStatus(err) == "" {
+				// приглашение еще может прийти, ESC закроет его без отправки
+				m.sendRaw(string(rune(escape)))
+			}
+			// без приглашения PDU не отправлялся, даже при тайм-ауте
+			result.Parts = append(result.Parts, PartResult{Part: i + 1, Status: SMSStatusError, Reference: -1, Code: errorCode(err), Err: err})
+			break
+		}
+
+		// EOM CTRL-Z = 26
+		if err := ctx.Err(); err != nil {
+			// приглашение уже есть, ESC выходит из него без отправки
+			m.sendRaw(string(rune(escape)))
+			result.Parts = append(result.Parts, PartResult{Part: i + 1, Status: SMSStatusError, Reference: -1, Err: err})
+			break
+		}
+		output, err := m.exchange(ctx, segment.PDU+string(rune(26)), false, SubmitTimeout)
+		status := answerStatus(err)
+		reference := -1
+		if mr := cmgsReference.FindStringSubmatch(output); mr != nil {
+			reference, _ = strconv.Atoi(mr[1])
+		}
+		log.Printf("SendSMS: part %d/%d status %q reference %d error %v", i+1, len(segments), status, reference, err)
+		result.Parts = append(result.Parts, PartResult{Part: i + 1, Status: status, Reference: reference, Code: errorCode(err), Err: err})
+		if status != SMSStatusOk {
+			// остальные части без этой бессмысленны, сообщение будет отправлено повторно целиком
+			break
+		}
+	}
+	return result
+}
+
+var cmglHeader = regexp.MustCompile(`\+CMGL:\s*(\d+),`)
+
+// ReadMessages читает входящие сообщения и отчеты о доставке из памяти модема (AT+CMGL=4).
+// Части составного сообщения возвращаются только когда получены все или истек
+// concatTimeout; до этого они остаются в памяти модема.
+func (m *GSMModem) ReadMessages() ([]*InboundSMS, []*StatusReport, error) {
+	log.Println("--- ReadMessages ", m.DeviceId)
+	m.session.Lock()
+	defer m.session.Unlock()
+
+	if _, err := m.command("AT+CMGF=0\r"); err != nil {
+		return nil, nil, err
+	}
+	output, err := m.command("AT+CMGL=4\r")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m.reportsMu.Lock()
+	reports := m.reports
+	m.reports = nil
+	m.reportsMu.Unlock()
+	var parts []inboundPart
+	lines := strings.Split(strings.Replace(output, "\r", "", -1), "\n")
+	for i := 0; i < len(lines)-1; i++ {
+		header := cmglHeader.FindStringSubmatch(lines[i])
+		if header == nil {
+			continue
+		}
+		index, _ := strconv.Atoi(header[1])
+		i++
+		if mti, _ := pduType(lines[i]); mti == 0x02 {
+			report, err := decodeStatusReportPDU(lines[i])
+			if err != nil {
+				log.Printf("ReadMessages: skipping report %d: %v", index, err)
+				continue
+			}
+			report.Index = index
+			reports = append(reports, report)
+			continue
+		}
+		p, err := decodeDeliverPDU(lines[i])
+		if err != nil {
+			log.Printf("ReadMessages: skipping message %d: %v", index, err)
+			continue
+		}
+		parts = append(parts, inboundPart{index, p})
+	}
+
+	return assembleInbound(parts, time.Now()), reports, nil
+}
 
-	m.SendCommand("AT+CMGF=0\r", true)
+// concatTimeout сколько ждать недостающие части составного сообщения. После этого
+// полученные части сохраняются как есть, иначе они навсегда займут память SIM
+const concatTimeout = 24 * time.Hour
 
-	message = fmt.Sprintf("0001000B91%s0008%s%s", convertMobile(mobile), convertCountMessage(message), hexUTF16FromString(message))
+// inboundPart часть входящего сообщения и ее номер в памяти модема
+type inboundPart struct {
+	index int
+	pdu   *deliverPDU
+}
 
-	lengthMessage := len([]rune(message))
-	m.SendCommand(fmt.Sprintf("AT+CMGS=%d\r", (lengthMessage -2) / 2, true), true)
+// assembleInbound склеивает части составных сообщений. Сообщение готово, когда есть все
+// части 1..total, неполное ждет следующего чтения, но не дольше concatTimeout. Часть с
+// номером вне 1..total склеить не с чем, она сохраняется отдельным сообщением
+func assembleInbound(parts []inboundPart, now time.Time) []*InboundSMS {
+	type concatKey struct {
+		sender     string
+		ref, total int
+	}
+	var messages []*InboundSMS
+	var keys []concatKey
+	concatParts := make(map[concatKey]map[int]*deliverPDU)
+	concatIndexes := make(map[concatKey][]int)
 
-	// EOM CTRL-Z = 26
-	return m.SendCommand(message+string(26), true)
+	for _, part := range parts {
+		p := part.pdu
+		if p.ConcatTotal > 1 && (p.ConcatPart < 1 || p.ConcatPart > p.ConcatTotal) {
+			log.Printf("assembleInbound: part %d of %d from %s is out of range, saving it alone", p.ConcatPart, p.ConcatTotal, p.Sender)
+		}
+		if p.ConcatTotal <= 1 || p.ConcatPart < 1 || p.ConcatPart > p.ConcatTotal {
+			messages = append(messages, &InboundSMS{Sender: p.Sender, Timestamp: p.Timestamp, Body: p.Text, Indexes: []int{part.index}})
+			continue
+		}
+
+		key := concatKey{p.Sender, p.ConcatRef, p.ConcatTotal}
+		if concatParts[key] == nil {
+			concatParts[key] = make(map[int]*deliverPDU)
+			keys = append(keys, key)
+		}
+		concatParts[key][p.ConcatPart] = p
+		concatIndexes[key] = append(concatIndexes[key], part.index)
+	}
+
+	for _, key := range keys {
+		sms := &InboundSMS{Sender: key.sender, Indexes: concatIndexes[key]}
+		var body strings.Builder
+		received := 0
+		for n := 1; n <= key.total; n++ {
+			p, ok := concatParts[key][n]
+			if !ok {
+				continue
+			}
+			received++
+			if sms.Timestamp.IsZero() || p.Timestamp.Before(sms.Timestamp) {
+				sms.Timestamp = p.Timestamp
+			}
+			body.WriteString(p.Text)
+		}
+		if received < key.total {
+			if now.Sub(sms.Timestamp) < concatTimeout {
+				log.Printf("assembleInbound: %d of %d parts from %s received, waiting", received, key.total, key.sender)
+				continue
+			}
+			log.Printf("assembleInbound: %d of %d parts from %s received, the rest did not come in %v, saving as is", received, key.total, key.sender, concatTimeout)
+		}
+		sms.Body = body.String()
+		messages = append(messages, sms)
+	}
+	return messages
+}
+
+// DeleteMessage удаляет сообщение из памяти модема
+func (m *GSMModem) DeleteMessage(index int) error {
+	_, err := m.Command(fmt.Sprintf("AT+CMGD=%d\r", index))
+	return err
 }
 
 func (m *GSMModem) transposeLog(input string) string {
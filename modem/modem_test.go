@@ -0,0 +1,75 @@
+package modem
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAssembleInbound(t *testing.T) {
+	now := time.Date(2015, 1, 23, 12, 0, 0, 0, time.UTC)
+	part := func(index, ref, total, n int, text string, age time.Duration) inboundPart {
+		return inboundPart{index, &deliverPDU{Sender: "+79001234567", Timestamp: now.Add(-age), Text: text,
+			ConcatRef: ref, ConcatTotal: total, ConcatPart: n}}
+	}
+	type message struct {
+		body    string
+		indexes []int
+	}
+	tests := []struct {
+		name  string
+		parts []inboundPart
+		want  []message
+	}{
+		{"single", []inboundPart{part(1, 0, 0, 0, "hello", 0)}, []message{{"hello", []int{1}}}},
+		{"all parts in any order", []inboundPart{part(2, 7, 2, 2, "world", 0), part(1, 7, 2, 1, "hello ", 0)},
+			[]message{{"hello world", []int{2, 1}}}},
+		{"missing part waits", []inboundPart{part(1, 7, 3, 1, "a", time.Hour), part(2, 7, 3, 3, "c", time.Hour)}, nil},
+		// номер вне 1..total не заменяет недостающую часть
+		{"part 0 does not count", []inboundPart{part(1, 7, 2, 1, "a", 0), part(2, 7, 2, 0, "x", 0)},
+			[]message{{"x", []int{2}}}},
+		{"part above total does not count", []inboundPart{part(1, 7, 2, 1, "a", 0), part(2, 7, 2, 3, "x", 0)},
+			[]message{{"x", []int{2}}}},
+		{"duplicate part does not count", []inboundPart{part(1, 7, 2, 1, "a", 0), part(2, 7, 2, 1, "a", 0)}, nil},
+		{"other reference is another message", []inboundPart{part(1, 7, 2, 1, "a", 0), part(2, 8, 2, 2, "b", 0)}, nil},
+		{"incomplete saved after timeout", []inboundPart{part(1, 7, 3, 1, "a", concatTimeout), part(2, 7, 3, 3, "c", time.Hour)},
+			[]message{{"ac", []int{1, 2}}}},
+	}
+	for _, tt := range tests {
+		got := assembleInbound(tt.parts, now)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %d messages, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i, sms := range got {
+			if sms.Body != tt.want[i].body || !equalInts(sms.Indexes, tt.want[i].indexes) {
+				t.Errorf("%s: message %q %v, want %q %v", tt.name, sms.Body, sms.Indexes, tt.want[i].body, tt.want[i].indexes)
+			}
+		}
+	}
+}
+
+func TestAnswerError(t *testing.T) {
+	tests := []struct {
+		output string
+		want   error
+	}{
+		{"\r\nOK\r\n", nil},
+		{"\r\n+CMGS: 5\r\n\r\nOK\r\n", nil},
+		{"\r\nERROR\r\n", ErrCommand},
+		{"\r\n+CMS ERROR: 331\r\n", &CMSError{Code: 331}},
+		{"\r\n+CMS ERROR: SMSC address unknown\r\n", &CMSError{Code: -1, Text: "SMSC address unknown"}},
+		{"\r\n+CME ERROR: 10\r\n", &CMEError{Code: 10}},
+		// код еще не пришел целиком
+		{"\r\n+CMS ERROR: 33", nil},
+	}
+	for _, tt := range tests {
+		got := answerError(tt.output)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) || fmt.Sprintf("%T", got) != fmt.Sprintf("%T", tt.want) {
+			t.Errorf("answerError(%q) = %#v, want %#v", tt.output, got, tt.want)
+		}
+		if code := errorCode(got); got != nil && got != ErrCommand && code != errorCode(tt.want) {
+			t.Errorf("errorCode(%q) = %d", tt.output, code)
+		}
+	}
+}
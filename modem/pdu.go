@@ -0,0 +1,411 @@
+package modem
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// maxUserDataOctets максимальная длина пользовательских данных одной части
+const maxUserDataOctets = 140
+
+// кодировки текста сообщения
+const (
+	EncodingGSM7 = "gsm7"
+	EncodingUCS2 = "ucs2"
+)
+
+// схемы кодирования данных (TP-DCS)
+const (
+	dcsGSM7 = 0x00
+	dcsUCS2 = 0x08
+)
+
+// информационные элементы UDH для склейки сообщений
+const (
+	ieiConcat8  = 0x00 // 8-битная ссылка
+	ieiConcat16 = 0x08 // 16-битная ссылка
+)
+
+// pduSegment одна часть сообщения, готовая к отправке через AT+CMGS
+type pduSegment struct {
+	PDU    string
+	Length int // длина TPDU в октетах без SMSC
+}
+
+// concatUDH формирует заголовок UDH для части part из total
+func concatUDH(ref uint16, total, part int, ref16 bool) []byte {
+	if ref16 {
+		return []byte{0x06, ieiConcat16, 0x04, byte(ref >> 8), byte(ref), byte(total), byte(part)}
+	}
+	return []byte{0x05, ieiConcat8, 0x03, byte(ref), byte(total), byte(part)}
+}
+
+// udhLength длина заголовка склейки в октетах
+func udhLength(ref16 bool) int {
+	if ref16 {
+		return 7
+	}
+	return 6
+}
+
+// splitUCS2 разбивает текст на части по UCS-2, не разрывая суррогатные пары
+func splitUCS2(message string, ref16 bool) [][]uint16 {
+	units := utf16.Encode([]rune(message))
+	if len(units)*2 <= maxUserDataOctets {
+		return [][]uint16{units}
+	}
+
+	perPart := (maxUserDataOctets - udhLength(ref16)) / 2
+	var parts [][]uint16
+	for len(units) > 0 {
+		n := perPart
+		if n >= len(units) {
+			n = len(units)
+		} else if utf16.IsSurrogate(rune(units[n-1])) && units[n-1] < 0xDC00 {
+			n--
+		}
+		parts = append(parts, units[:n])
+		units = units[n:]
+	}
+	return parts
+}
+
+// encodeUCS2 кодирует части UTF-16 в октеты big-endian
+func encodeUCS2(units []uint16) []byte {
+	data := make([]byte, 0, len(units)*2)
+	for _, u := range units {
+		data = append(data, byte(u>>8), byte(u))
+	}
+	return data
+}
+
+// encodeAddress кодирует номер получателя: длина, тип и полуоктеты
+func encodeAddress(number string) string {
+	number = strings.TrimPrefix(number, "+")
+	return fmt.Sprintf("%02X91%s", len(number), convertMobile(number))
+}
+
+// submitOptions параметры сборки SMS-SUBMIT
+type submitOptions struct {
+	ref          uint16 // ссылка склейки частей
+	ref16        bool   // 16-битная ссылка склейки
+	statusReport bool   // запросить отчет о доставке (TP-SRR)
+}
+
+// buildSubmitPDU собирает SMS-SUBMIT PDU с SMSC по умолчанию
+func buildSubmitPDU(mobile string, dcs byte, udl int, ud []byte, udhi bool, opts submitOptions) pduSegment {
+	firstOctet := byte(0x01) // SMS-SUBMIT
+	if udhi {
+		firstOctet |= 0x40
+	}
+	if opts.statusReport {
+		firstOctet |= 0x20
+	}
+
+	tpdu := fmt.Sprintf("%02X00%s00%02X%02X%X", firstOctet, encodeAddress(mobile), dcs, udl, ud)
+	return pduSegment{PDU: "00" + tpdu, Length: len(tpdu) / 2}
+}
+
+// buildSubmitPDUs разбивает сообщение на части и собирает PDU для каждой.
+// GSM 7-bit выбирается автоматически, если все символы в нем представимы.
+func buildSubmitPDUs(mobile, message string, opts submitOptions) []pduSegment {
+	if septets, ok := encodeGSM7(message); ok {
+		parts := splitGSM7(septets, opts.ref16)
+		if len(parts) == 1 {
+			return []pduSegment{buildSubmitPDU(mobile, dcsGSM7, len(septets), packSeptets(septets, 0), false, opts)}
+		}
+
+		udhBits := udhLength(opts.ref16) * 8
+		fill := (7 - udhBits%7) % 7
+		segments := make([]pduSegment, 0, len(parts))
+		for i, part := range parts {
+			udh := concatUDH(opts.ref, len(parts), i+1, opts.ref16)
+			ud := append(udh, packSeptets(part, fill)...)
+			segments = append(segments, buildSubmitPDU(mobile, dcsGSM7, (udhBits+fill)/7+len(part), ud, true, opts))
+		}
+		return segments
+	}
+
+	parts := splitUCS2(message, opts.ref16)
+	if len(parts) == 1 {
+		ud := encodeUCS2(parts[0])
+		return []pduSegment{buildSubmitPDU(mobile, dcsUCS2, len(ud), ud, false, opts)}
+	}
+
+	segments := make([]pduSegment, 0, len(parts))
+	for i, part := range parts {
+		ud := append(concatUDH(opts.ref, len(parts), i+1, opts.ref16), encodeUCS2(part)...)
+		segments = append(segments, buildSubmitPDU(mobile, dcsUCS2, len(ud), ud, true, opts))
+	}
+	return segments
+}
+
+// MessageInfo сведения о том, как сообщение будет отправлено
+type MessageInfo struct {
+	Encoding string `json:"encoding"`
+	Segments int    `json:"segments"`
+	// Remaining сколько символов еще поместится в последнюю часть без новой части: символов
+	// основной таблицы GSM 7 или BMP для UCS-2. Символ расширения (€, {, [...) и emoji
+	// занимают место двух
+	Remaining int `json:"remaining"`
+}
+
+// Estimate возвращает кодировку, число частей и остаток символов для текста сообщения
+func Estimate(message string, ref16 bool) MessageInfo {
+	if septets, ok := encodeGSM7(message); ok {
+		parts := splitGSM7(septets, ref16)
+		// символ основной таблицы - один септет
+		charsPerPart := maxUserDataOctets * 8 / 7
+		if len(parts) > 1 {
+			charsPerPart = (maxUserDataOctets - udhLength(ref16)) * 8 / 7
+		}
+		return MessageInfo{
+			Encoding:  EncodingGSM7,
+			Segments:  len(parts),
+			Remaining: charsPerPart - len(parts[len(parts)-1]),
+		}
+	}
+
+	parts := splitUCS2(message, ref16)
+	// символ BMP - одна единица UTF-16
+	charsPerPart := maxUserDataOctets / 2
+	if len(parts) > 1 {
+		charsPerPart = (maxUserDataOctets - udhLength(ref16)) / 2
+	}
+	return MessageInfo{
+		Encoding:  EncodingUCS2,
+		Segments:  len(parts),
+		Remaining: charsPerPart - len(parts[len(parts)-1]),
+	}
+}
+
+// deliverPDU разобранная часть входящего SMS-DELIVER
+type deliverPDU struct {
+	Sender      string
+	Timestamp   time.Time
+	DCS         byte
+	Text        string
+	ConcatRef   int
+	ConcatTotal int
+	ConcatPart  int
+}
+
+// pduReader последовательное чтение октетов PDU
+type pduReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *pduReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = errors.New("PDU is too short")
+		return make([]byte, n)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *pduReader) octet() byte {
+	return r.next(1)[0]
+}
+
+// decodeSemiOctets разворачивает полуоктеты, отбрасывая заполнитель F
+func decodeSemiOctets(data []byte) string {
+	var digits strings.Builder
+	for _, b := range data {
+		for _, d := range []byte{b & 0x0F, b >> 4} {
+			if d == 0x0F {
+				continue
+			}
+			digits.WriteString(strconv.Itoa(int(d)))
+		}
+	}
+	return digits.String()
+}
+
+// address читает адрес: длина в полуоктетах, тип и значение
+func (r *pduReader) address() string {
+	length := int(r.octet())
+	toa := r.octet()
+	data := r.next((length + 1) / 2)
+	switch toa & 0x70 {
+	case 0x50: // буквенно-цифровой отправитель в GSM 7-bit
+		return decodeGSM7(unpackSeptets(data, length*4/7, 0))
+	case 0x10: // международный формат
+		return "+" + decodeSemiOctets(data)
+	}
+	return decodeSemiOctets(data)
+}
+
+// timestamp читает TP-SCTS: YY MM DD hh mm ss TZ в переставленных полуоктетах
+func (r *pduReader) timestamp() time.Time {
+	data := r.next(7)
+	v := make([]int, 6)
+	for i := range v {
+		v[i] = int(data[i]&0x0F)*10 + int(data[i]>>4)
+	}
+	tz := int(data[6]&0x07)*10 + int(data[6]>>4)
+	if data[6]&0x08 != 0 {
+		tz = -tz
+	}
+	location := time.FixedZone("", tz*15*60)
+	return time.Date(2000+v[0], time.Month(v[1]), v[2], v[3], v[4], v[5], 0, location)
+}
+
+// dcsAlphabet определяет кодировку текста по TP-DCS
+func dcsAlphabet(dcs byte) byte {
+	switch {
+	case dcs&0xC0 == 0x00:
+		return dcs & 0x0C
+	case dcs&0xF0 == 0xE0:
+		return dcsUCS2
+	case dcs&0xF0 == 0xF0:
+		return dcs & 0x04
+	}
+	return dcsGSM7
+}
+
+// decodeUserData разбирает UDH (склейку) и текст сообщения
+func (p *deliverPDU) decodeUserData(udl int, ud []byte, udhi bool) {
+	alphabet := dcsAlphabet(p.DCS)
+	headerLen := 0
+	if udhi && len(ud) > 0 {
+		headerLen = int(ud[0]) + 1
+		if headerLen > len(ud) {
+			headerLen = len(ud)
+		}
+		header := ud[1:headerLen]
+		for i := 0; i+1 < len(header); i += 2 + int(header[i+1]) {
+			iei, ieLen := header[i], int(header[i+1])
+			if i+2+ieLen > len(header) {
+				break
+			}
+			ie := header[i+2 : i+2+ieLen]
+			if iei == ieiConcat8 && ieLen == 3 {
+				p.ConcatRef, p.ConcatTotal, p.ConcatPart = int(ie[0]), int(ie[1]), int(ie[2])
+			} else if iei == ieiConcat16 && ieLen == 4 {
+				p.ConcatRef, p.ConcatTotal, p.ConcatPart = int(ie[0])<<8|int(ie[1]), int(ie[2]), int(ie[3])
+			}
+		}
+	}
+
+	switch alphabet {
+	case dcsGSM7:
+		headerSeptets := (headerLen*8 + 6) / 7
+		septets := unpackSeptets(ud, udl, 0)
+		if headerSeptets > len(septets) {
+			headerSeptets = len(septets)
+		}
+		p.Text = decodeGSM7(septets[headerSeptets:])
+	case dcsUCS2:
+		data := ud[headerLen:]
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+		}
+		p.Text = string(utf16.Decode(units))
+	default:
+		p.Text = string(ud[headerLen:])
+	}
+}
+
+// decodeDeliverPDU разбирает PDU входящего сообщения SMS-DELIVER
+func decodeDeliverPDU(hexPDU string) (*deliverPDU, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(hexPDU))
+	if err != nil {
+		return nil, err
+	}
+	r := &pduReader{data: data}
+	r.next(int(r.octet())) // SMSC
+
+	firstOctet := r.octet()
+	if firstOctet&0x03 != 0x00 {
+		return nil, fmt.Errorf("not an SMS-DELIVER PDU, first octet %02X", firstOctet)
+	}
+
+	p := &deliverPDU{}
+	p.Sender = r.address()
+	r.octet() // TP-PID
+	p.DCS = r.octet()
+	p.Timestamp = r.timestamp()
+	udl := int(r.octet())
+	ud := r.data[r.pos:]
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	p.decodeUserData(udl, ud, firstOctet&0x40 != 0)
+	return p, nil
+}
+
+// StatusReport отчет о доставке SMS-STATUS-REPORT
+type StatusReport struct {
+	Reference int       // TP-MR отправленной части
+	Recipient string    // номер получателя
+	Status    byte      // TP-ST
+	Timestamp time.Time // время доставки или неудачи (TP-DT)
+	Index     int       // ячейка памяти модема, -1 если отчет пришел через +CDS
+}
+
+// Delivered сообщение доставлено получателю
+func (r *StatusReport) Delivered() bool {
+	return r.Status <= 0x02
+}
+
+// Expired истек срок хранения сообщения в SMSC
+func (r *StatusReport) Expired() bool {
+	return r.Status == 0x46
+}
+
+// Final SMSC больше не будет пытаться доставить сообщение
+func (r *StatusReport) Final() bool {
+	return r.Status < 0x20 || r.Status >= 0x40
+}
+
+// decodeStatusReportPDU разбирает PDU отчета о доставке
+func decodeStatusReportPDU(hexPDU string) (*StatusReport, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(hexPDU))
+	if err != nil {
+		return nil, err
+	}
+	r := &pduReader{data: data}
+	r.next(int(r.octet())) // SMSC
+
+	firstOctet := r.octet()
+	if firstOctet&0x03 != 0x02 {
+		return nil, fmt.Errorf("not an SMS-STATUS-REPORT PDU, first octet %02X", firstOctet)
+	}
+
+	report := &StatusReport{Index: -1}
+	report.Reference = int(r.octet())
+	report.Recipient = r.address()
+	r.timestamp() // TP-SCTS
+	report.Timestamp = r.timestamp()
+	report.Status = r.octet()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return report, nil
+}
+
+// pduType тип входящего PDU по TP-MTI: 0 - SMS-DELIVER, 2 - SMS-STATUS-REPORT
+func pduType(hexPDU string) (byte, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(hexPDU))
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < 1 || len(data) < int(data[0])+2 {
+		return 0, errors.New("PDU is too short")
+	}
+	return data[int(data[0])+1] & 0x03, nil
+}
@@ -0,0 +1,253 @@
+package modem
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// submitUserData разбирает SMS-SUBMIT, собранный buildSubmitPDU, и расшифровывает текст части
+func submitUserData(t *testing.T, pdu string) *deliverPDU {
+	t.Helper()
+	data, err := hex.DecodeString(pdu)
+	if err != nil {
+		t.Fatalf("bad PDU %s: %v", pdu, err)
+	}
+	pos := 1 + int(data[0]) // SMSC
+	firstOctet := data[pos]
+	pos += 2                        // FO, MR
+	pos += 2 + (int(data[pos])+1)/2 // DA
+	pos++                           // PID
+	p := &deliverPDU{DCS: data[pos]}
+	udl := int(data[pos+1])
+	p.decodeUserData(udl, data[pos+2:], firstOctet&0x40 != 0)
+	return p
+}
+
+func TestPackSeptets(t *testing.T) {
+	septets, ok := encodeGSM7("hellohello")
+	if !ok {
+		t.Fatal("hellohello is GSM 7-bit")
+	}
+	if got := strings.ToUpper(hex.EncodeToString(packSeptets(septets, 0))); got != "E8329BFD4697D9EC37" {
+		t.Errorf("packSeptets = %s, want E8329BFD4697D9EC37", got)
+	}
+
+	// после UDH в 6 октетов биты выравнивания ставят текст на границу септета
+	for fill := 0; fill < 7; fill++ {
+		packed := packSeptets(septets, fill)
+		if got := decodeGSM7(unpackSeptets(packed, len(septets), fill)); got != "hellohello" {
+			t.Errorf("fill %d: unpacked %q", fill, got)
+		}
+	}
+}
+
+func TestEncodeGSM7(t *testing.T) {
+	tests := []struct {
+		text    string
+		septets int
+		ok      bool
+	}{
+		{"hello", 5, true},
+		{"@£$", 3, true},
+		{"€", 2, true},
+		{"[x]", 5, true},
+		{"привет", 0, false},
+		{"😀", 0, false},
+	}
+	for _, tt := range tests {
+		septets, ok := encodeGSM7(tt.text)
+		if ok != tt.ok || len(septets) != tt.septets {
+			t.Errorf("encodeGSM7(%q) = %d septets, %v; want %d, %v", tt.text, len(septets), ok, tt.septets, tt.ok)
+			continue
+		}
+		if ok && decodeGSM7(septets) != tt.text {
+			t.Errorf("decodeGSM7(encodeGSM7(%q)) = %q", tt.text, decodeGSM7(septets))
+		}
+	}
+}
+
+func TestSplitGSM7(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		ref16 bool
+		parts []int
+	}{
+		{"single part limit", strings.Repeat("a", 160), false, []int{160}},
+		{"one over", strings.Repeat("a", 161), false, []int{153, 8}},
+		{"two full parts", strings.Repeat("a", 306), false, []int{153, 153}},
+		{"three parts", strings.Repeat("a", 307), false, []int{153, 153, 1}},
+		{"16-bit reference", strings.Repeat("a", 161), true, []int{152, 9}},
+		{"extension fills single part", strings.Repeat("€", 80), false, []int{160}},
+		// ESC оказался бы последним септетом части 1, вся последовательность уходит в часть 2
+		{"extension at split point", strings.Repeat("a", 152) + "€" + strings.Repeat("b", 10), false, []int{152, 12}},
+		{"extension right before split point", strings.Repeat("a", 151) + "€" + strings.Repeat("b", 10), false, []int{153, 10}},
+	}
+	for _, tt := range tests {
+		septets, _ := encodeGSM7(tt.text)
+		parts := splitGSM7(septets, tt.ref16)
+		var lengths []int
+		var text string
+		for _, part := range parts {
+			lengths = append(lengths, len(part))
+			text += decodeGSM7(part)
+		}
+		if !equalInts(lengths, tt.parts) {
+			t.Errorf("%s: parts %v, want %v", tt.name, lengths, tt.parts)
+		}
+		if text != tt.text {
+			t.Errorf("%s: parts decode to %q", tt.name, text)
+		}
+	}
+}
+
+func TestSplitUCS2(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		ref16 bool
+		parts []int
+	}{
+		{"single part limit", strings.Repeat("ж", 70), false, []int{70}},
+		{"one over", strings.Repeat("ж", 71), false, []int{67, 4}},
+		{"two full parts", strings.Repeat("ж", 134), false, []int{67, 67}},
+		{"16-bit reference", strings.Repeat("ж", 71), true, []int{66, 5}},
+		{"emoji fill single part", strings.Repeat("😀", 35), false, []int{70}},
+		// старший суррогат оказался бы последним в части 1, пара целиком уходит в часть 2
+		{"emoji at split point", strings.Repeat("ж", 66) + "😀" + strings.Repeat("ж", 5), false, []int{66, 7}},
+		{"emoji right before split point", strings.Repeat("ж", 65) + "😀" + strings.Repeat("ж", 5), false, []int{67, 5}},
+	}
+	for _, tt := range tests {
+		parts := splitUCS2(tt.text, tt.ref16)
+		var lengths []int
+		var text string
+		for _, part := range parts {
+			lengths = append(lengths, len(part))
+			// каждая часть должна раскодироваться сама по себе, без разорванной пары
+			text += string(utf16.Decode(part))
+		}
+		if !equalInts(lengths, tt.parts) {
+			t.Errorf("%s: parts %v, want %v", tt.name, lengths, tt.parts)
+		}
+		if text != tt.text {
+			t.Errorf("%s: parts decode to %q", tt.name, text)
+		}
+	}
+}
+
+func TestBuildSubmitPDUs(t *testing.T) {
+	tests := []struct {
+		text   string
+		pdu    string
+		length int
+	}{
+		{"hellohello", "0001000B916407281553F800000AE8329BFD4697D9EC37", 22},
+		{"ж", "0001000B916407281553F80008020436", 15},
+	}
+	for _, tt := range tests {
+		segments := buildSubmitPDUs("+46708251358", tt.text, submitOptions{ref: 1})
+		if len(segments) != 1 {
+			t.Errorf("%q: %d segments, want 1", tt.text, len(segments))
+			continue
+		}
+		if segments[0].PDU != tt.pdu || segments[0].Length != tt.length {
+			t.Errorf("%q: PDU %s, Length %d; want %s, %d", tt.text, segments[0].PDU, segments[0].Length, tt.pdu, tt.length)
+		}
+	}
+
+	report := buildSubmitPDUs("+46708251358", "hi", submitOptions{statusReport: true})
+	if !strings.HasPrefix(report[0].PDU, "0021") {
+		t.Errorf("status report not requested: %s", report[0].PDU)
+	}
+}
+
+func TestBuildSubmitPDUsMultipart(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		ref16    bool
+		dcs      byte
+		segments int
+	}{
+		{"gsm7", strings.Repeat("0123456789", 20), false, dcsGSM7, 2},
+		{"gsm7 16-bit reference", strings.Repeat("0123456789", 20), true, dcsGSM7, 2},
+		{"gsm7 extension at split point", strings.Repeat("a", 152) + "{}" + strings.Repeat("b", 10), false, dcsGSM7, 2},
+		{"ucs2", strings.Repeat("привет ", 20), false, dcsUCS2, 3},
+		{"ucs2 emoji at split point", strings.Repeat("ж", 66) + "😀😀" + strings.Repeat("ж", 5), true, dcsUCS2, 2},
+	}
+	for _, tt := range tests {
+		segments := buildSubmitPDUs("+79001234567", tt.text, submitOptions{ref: 0x1234, ref16: tt.ref16})
+		if len(segments) != tt.segments {
+			t.Errorf("%s: %d segments, want %d", tt.name, len(segments), tt.segments)
+			continue
+		}
+		var text string
+		for i, segment := range segments {
+			if segment.Length*2+2 != len(segment.PDU) {
+				t.Errorf("%s: part %d Length %d does not match PDU", tt.name, i+1, segment.Length)
+			}
+			if segment.Length > 164 {
+				t.Errorf("%s: part %d is %d octets long", tt.name, i+1, segment.Length)
+			}
+			p := submitUserData(t, segment.PDU)
+			if p.DCS != tt.dcs {
+				t.Errorf("%s: part %d DCS %02X", tt.name, i+1, p.DCS)
+			}
+			ref := 0x34
+			if tt.ref16 {
+				ref = 0x1234
+			}
+			if p.ConcatRef != ref || p.ConcatTotal != len(segments) || p.ConcatPart != i+1 {
+				t.Errorf("%s: part %d UDH ref %X %d/%d", tt.name, i+1, p.ConcatRef, p.ConcatPart, p.ConcatTotal)
+			}
+			text += p.Text
+		}
+		if text != tt.text {
+			t.Errorf("%s: parts decode to %q", tt.name, text)
+		}
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want MessageInfo
+	}{
+		{"empty", "", MessageInfo{EncodingGSM7, 1, 160}},
+		{"short", "hello", MessageInfo{EncodingGSM7, 1, 155}},
+		{"single part limit", strings.Repeat("a", 160), MessageInfo{EncodingGSM7, 1, 0}},
+		{"one over", strings.Repeat("a", 161), MessageInfo{EncodingGSM7, 2, 145}},
+		{"two full parts", strings.Repeat("a", 306), MessageInfo{EncodingGSM7, 2, 0}},
+		{"three parts", strings.Repeat("a", 307), MessageInfo{EncodingGSM7, 3, 152}},
+		// символ расширения занимает место двух
+		{"extension", strings.Repeat("€", 79), MessageInfo{EncodingGSM7, 1, 2}},
+		{"extension at split point", strings.Repeat("a", 152) + "€", MessageInfo{EncodingGSM7, 1, 6}},
+		{"extension moved to part 2", strings.Repeat("a", 152) + "€" + strings.Repeat("b", 10), MessageInfo{EncodingGSM7, 2, 141}},
+		{"ucs2 single part limit", strings.Repeat("ж", 70), MessageInfo{EncodingUCS2, 1, 0}},
+		{"ucs2 one over", strings.Repeat("ж", 71), MessageInfo{EncodingUCS2, 2, 63}},
+		{"ucs2 two full parts", strings.Repeat("ж", 134), MessageInfo{EncodingUCS2, 2, 0}},
+		// emoji занимает место двух
+		{"emoji", strings.Repeat("😀", 34), MessageInfo{EncodingUCS2, 1, 2}},
+		{"emoji at split point", strings.Repeat("ж", 66) + "😀" + strings.Repeat("ж", 4), MessageInfo{EncodingUCS2, 2, 61}},
+	}
+	for _, tt := range tests {
+		if got := Estimate(tt.text, false); got != tt.want {
+			t.Errorf("%s: Estimate = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,217 @@
+package modem
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// URC незапрошенный ответ модема
+type URC struct {
+	Code string // +CMTI, +CDSI, +CDS, +CREG, +CUSD или RING
+	Line string // строка ответа целиком
+	PDU  string // для +CDS: PDU отчета о доставке со следующей строки
+}
+
+// urcCodes ответы, которые модем присылает сам, а не в ответ на команду
+var urcCodes = []string{"+CMTI", "+CDSI", "+CDS", "+CREG", "+CUSD", "RING"}
+
+// promptLine приглашение для ввода PDU после AT+CMGS, приходит без перевода строки
+const promptLine = "> "
+
+// subscriberBuffer сколько ответов ждут подписчика, пока он их не прочитает
+const subscriberBuffer = 16
+
+// lineReader читает порт одного подключения в своей горутине: ответы на команды
+// передает в lines, незапрошенные ответы - подписчикам
+type lineReader struct {
+	port  Port
+	lines chan string
+	// done закрыт, когда порт закрыт и чтение прекращено
+	done chan struct{}
+	// cds ждет вторую строку +CDS с PDU
+	cds *URC
+}
+
+type subscription struct {
+	codes []string
+	ch    chan URC
+}
+
+// subscribers подписчики на незапрошенные ответы, см. Subscribe
+type subscribers struct {
+	mu   sync.Mutex
+	list []*subscription
+}
+
+func (m *GSMModem) startReader(port Port) *lineReader {
+	r := &lineReader{port: port, lines: make(chan string, 64), done: make(chan struct{})}
+	go m.readLoop(port, r)
+	return r
+}
+
+func (m *GSMModem) readLoop(port Port, r *lineReader) {
+	defer close(r.done)
+	var pending string
+	buf := make([]byte, 256)
+	for {
+		// ignoring other errors as EOF raises error on Linux
+		n, err := port.Read(buf)
+		if n == 0 {
+			if portError(err) == ErrPortClosed {
+				log.Println("readLoop: ", m.DeviceId, "port closed")
+				return
+			}
+			continue
+		}
+		log.Printf("readLoop: received %d bytes: %#v\n", n, string(buf[:n]))
+		pending += string(buf[:n])
+		for {
+			pending = strings.TrimLeft(pending, "\r\n")
+			line, rest, ok := splitLine(pending)
+			if !ok {
+				break
+			}
+			pending = rest
+			m.handleLine(r, strings.TrimSpace(line))
+		}
+		if strings.TrimSpace(pending) == ">" {
+			pending = ""
+			m.handleLine(r, promptLine)
+		}
+	}
+}
+
+// splitLine отделяет первую строку. Строка +CUSD может занимать несколько строк,
+// пока не закрыта кавычка с текстом ответа сети
+func splitLine(data string) (line, rest string, ok bool) {
+	quoted := strings.HasPrefix(data, "+CUSD:")
+	inQuotes := false
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '"':
+			inQuotes = quoted && !inQuotes
+		case '\r', '\n':
+			if !inQuotes {
+				return data[:i], data[i+1:], true
+			}
+		}
+	}
+	return "", data, false
+}
+
+// urcCode код незапрошенного ответа, пустой если строка относится к команде
+func (m *GSMModem) urcCode(line string) string {
+	for _, code := range urcCodes {
+		if line != code && !strings.HasPrefix(line, code+":") {
+			continue
+		}
+		// +CREG: <n>,<stat> ответ на AT+CREG?, а не уведомление о смене регистрации
+		if code == "+CREG" && strings.HasPrefix(m.currentCommand(), "AT+CREG") {
+			return ""
+		}
+		return code
+	}
+	return ""
+}
+
+func (m *GSMModem) handleLine(r *lineReader, line string) {
+	if r.cds != nil {
+		urc := *r.cds
+		urc.PDU = line
+		r.cds = nil
+		m.publish(urc)
+		return
+	}
+	if code := m.urcCode(line); code != "" {
+		if code == "+CDS" {
+			r.cds = &URC{Code: code, Line: line}
+			return
+		}
+		m.publish(URC{Code: code, Line: line})
+		return
+	}
+	select {
+	case r.lines <- line:
+	default:
+		log.Println("handleLine: ", m.DeviceId, "nobody reads answers, dropping", line)
+	}
+}
+
+var cregURC = regexp.MustCompile(`^\+CREG:\s*(\d+)`)
+
+// publish обрабатывает незапрошенный ответ сам и передает его подписчикам
+func (m *GSMModem) publish(urc URC) {
+	log.Printf("publish: %s %#v", m.DeviceId, urc)
+	switch urc.Code {
+	case "+CMTI", "+CDSI":
+		m.notifyIncoming()
+	case "+CDS":
+		report, err := decodeStatusReportPDU(urc.PDU)
+		if err != nil {
+			log.Println("publish: ", err)
+			break
+		}
+		m.reportsMu.Lock()
+		m.reports = append(m.reports, report)
+		m.reportsMu.Unlock()
+		m.notifyIncoming()
+	case "+CREG":
+		if match := cregURC.FindStringSubmatch(urc.Line); match != nil {
+			m.recordRegistration(match[1])
+		}
+	}
+
+	m.subscribers.mu.Lock()
+	defer m.subscribers.mu.Unlock()
+	for _, s := range m.subscribers.list {
+		if len(s.codes) > 0 && !containsCode(s.codes, urc.Code) {
+			continue
+		}
+		select {
+		case s.ch <- urc:
+		default:
+			log.Println("publish: ", m.DeviceId, "subscriber is not reading, dropping", urc.Line)
+		}
+	}
+}
+
+func containsCode(codes []string, code string) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe канал незапрошенных ответов с перечисленными кодами (+CMTI, +CUSD...), без кодов - всех.
+// Ответы, которые подписчик не успевает читать, отбрасываются. Вызовите unsubscribe, когда канал
+// больше не нужен
+func (m *GSMModem) Subscribe(codes ...string) (urcs <-chan URC, unsubscribe func()) {
+	s := &subscription{codes: codes, ch: make(chan URC, subscriberBuffer)}
+	m.subscribers.mu.Lock()
+	m.subscribers.list = append(m.subscribers.list, s)
+	m.subscribers.mu.Unlock()
+	return s.ch, func() {
+		m.subscribers.mu.Lock()
+		defer m.subscribers.mu.Unlock()
+		for i, other := range m.subscribers.list {
+			if other == s {
+				m.subscribers.list = append(m.subscribers.list[:i], m.subscribers.list[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// wait ждет, пока читатель закрытого порта завершится
+func (r *lineReader) wait() {
+	select {
+	case <-r.done:
+	case <-time.After(2 * time.Second):
+		log.Println("lineReader: reader did not stop after the port was closed")
+	}
+}
@@ -0,0 +1,110 @@
+package modem
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		line string
+		rest string
+		ok   bool
+	}{
+		{"answer", "OK\r\n+CMTI: \"SM\",1\r\n", "OK", "\n+CMTI: \"SM\",1\r\n", true},
+		{"incomplete", "+CMGS: 1", "", "+CMGS: 1", false},
+		{"quotes outside +CUSD", "+CMTI: \"SM\r\",1\r\n", "+CMTI: \"SM", "\",1\r\n", true},
+		// ответ сети в кавычках может занимать несколько строк
+		{"multi-line +CUSD", "+CUSD: 0,\"Balance:\r\n100 RUB\",15\r\nOK\r\n", "+CUSD: 0,\"Balance:\r\n100 RUB\",15", "\nOK\r\n", true},
+		{"+CUSD without closing quote", "+CUSD: 0,\"Balance:\r\n100", "", "+CUSD: 0,\"Balance:\r\n100", false},
+		{"+CUSD without text", "+CUSD: 4\r\n", "+CUSD: 4", "\n", true},
+	}
+	for _, tt := range tests {
+		line, rest, ok := splitLine(tt.data)
+		if line != tt.line || rest != tt.rest || ok != tt.ok {
+			t.Errorf("%s: splitLine = %q, %q, %v; want %q, %q, %v", tt.name, line, rest, ok, tt.line, tt.rest, tt.ok)
+		}
+	}
+}
+
+// nextURC ждет незапрошенный ответ, nil если его нет
+func nextURC(urcs <-chan URC) *URC {
+	select {
+	case urc := <-urcs:
+		return &urc
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestHandleLineURC(t *testing.T) {
+	m := NewWithPort("sim0", NewSimulator())
+	r := &lineReader{lines: make(chan string, 8), done: make(chan struct{})}
+	sms, unsubscribe := m.Subscribe("+CMTI", "+CDSI")
+	all, unsubscribeAll := m.Subscribe()
+	defer unsubscribeAll()
+
+	// ответ на команду уходит тому, кто ее отправил, а не подписчикам
+	m.handleLine(r, "OK")
+	if line := <-r.lines; line != "OK" {
+		t.Errorf("answer %q", line)
+	}
+
+	m.handleLine(r, `+CMTI: "SM",3`)
+	if urc := nextURC(sms); urc == nil || urc.Code != "+CMTI" || urc.Line != `+CMTI: "SM",3` {
+		t.Errorf("+CMTI: %+v", urc)
+	}
+	select {
+	case <-m.Incoming():
+	default:
+		t.Errorf("+CMTI did not notify about an incoming message")
+	}
+	if urc := nextURC(all); urc == nil || urc.Code != "+CMTI" {
+		t.Errorf("subscriber to all codes: %+v", urc)
+	}
+
+	// подписчик получает только свои коды
+	m.handleLine(r, "+CREG: 5")
+	if urc := nextURC(sms); urc != nil {
+		t.Errorf("+CREG delivered to a +CMTI subscriber: %+v", urc)
+	}
+	if urc := nextURC(all); urc == nil || urc.Code != "+CREG" {
+		t.Errorf("+CREG: %+v", urc)
+	}
+
+	// PDU отчета о доставке приходит следующей строкой
+	m.handleLine(r, "+CDS: 25")
+	m.handleLine(r, "0006D60B911326880736F4111011719551401110117195714000")
+	if urc := nextURC(all); urc == nil || urc.Code != "+CDS" || urc.PDU != "0006D60B911326880736F4111011719551401110117195714000" {
+		t.Errorf("+CDS: %+v", urc)
+	}
+	if len(r.lines) != 0 {
+		t.Errorf("URC lines leaked into answers")
+	}
+
+	unsubscribe()
+	m.handleLine(r, `+CMTI: "SM",4`)
+	if urc := nextURC(sms); urc != nil {
+		t.Errorf("delivered after unsubscribe: %+v", urc)
+	}
+}
+
+func TestUSSDMultiline(t *testing.T) {
+	m, port := connectSimulator(t)
+	port.USSDAnswers = map[string]string{"*100#": "Balance:\r\n100 RUB"}
+
+	answer, err := m.USSD("*100#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(answer, "Balance:") || !strings.Contains(answer, "100 RUB") {
+		t.Errorf("USSD answer %q", answer)
+	}
+	// после многострочного ответа модем отвечает на команды как обычно
+	if _, err := m.Command("AT\r"); err != nil {
+		t.Errorf("AT after USSD: %v", err)
+	}
+}
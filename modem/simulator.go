@@ -0,0 +1,448 @@
+package modem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SimulatorPort значение COMPORT, при котором вместо порта используется Simulator
+const SimulatorPort = "simulator"
+
+// ctrlZ конец PDU в AT+CMGS
+const ctrlZ = 0x1A
+
+// escape отменяет ввод PDU после приглашения AT+CMGS
+const escape = 0x1B
+
+// ErrSimulatorClosed чтение или запись после Close
+var ErrSimulatorClosed = errors.New("simulator: port is closed")
+
+// SimulatedSMS сообщение, принятое симулятором через AT+CMGS
+type SimulatedSMS struct {
+	PDU       string
+	Reference int
+	SentAt    time.Time
+}
+
+// simulatedFault ответ, подменяющий обработку команды
+type simulatedFault struct {
+	prefix   string
+	response string // пустая строка - команда остается без ответа
+	count    int
+}
+
+// Simulator программный GSM модем, реализует Port и понимает диалект AT команд GSMModem:
+// ATE, AT+CMEE, AT+CMGF, AT+CNMI, AT+CMGS с приглашением "> " и Ctrl-Z, AT+CMGL, AT+CMGR, AT+CMGD,
+// AT+CPIN? и AT+CPIN=, AT+CSCA, AT+CPMS, AT+CUSD, а также AT+CGMI, AT+CREG?, AT+CSQ, AT+COPS?, AT+CGSN,
+// AT+CIMI, AT+CCID, AT+CNUM и AT+CBC.
+// Позволяет подставлять ошибки (+CMS ERROR, таймауты) для прогона шлюза без оборудования.
+type Simulator struct {
+	// ReadTimeout сколько Read ждет данных, как ReadTimeout последовательного порта
+	ReadTimeout time.Duration
+	// StatusReports сразу класть отчет о доставке в память, если он запрошен в PDU
+	StatusReports bool
+	// PIN код SIM: пока он не введен, AT+CPIN? отвечает SIM PIN, после трех неверных - SIM PUK
+	PIN string
+	// USSDAnswers ответы сети на USSD запросы, на остальные +CUSD: 4
+	USSDAnswers map[string]string
+
+	mu         sync.Mutex
+	closed     bool
+	echo       bool
+	input      bytes.Buffer
+	output     bytes.Buffer
+	pduLength  int // ожидаемая длина PDU после AT+CMGS, 0 - ждем команду
+	reference  int
+	storage    map[int]string
+	nextIndex  int
+	faults     []*simulatedFault
+	sent       []SimulatedSMS
+	commandLog []string
+	unlocked   bool
+	pinErrors  int
+}
+
+func NewSimulator() *Simulator {
+	return &Simulator{
+		ReadTimeout: time.Second,
+		echo:        true,
+		storage:     make(map[int]string),
+		USSDAnswers: map[string]string{"*100#": "Balance 100.00 RUB"},
+	}
+}
+
+// Read возвращает накопленные ответы, ждет не дольше ReadTimeout
+func (s *Simulator) Read(b []byte) (int, error) {
+	deadline := time.Now().Add(s.ReadTimeout)
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return 0, ErrSimulatorClosed
+		}
+		if s.output.Len() > 0 {
+			n, _ := s.output.Read(b)
+			s.mu.Unlock()
+			return n, nil
+		}
+		s.mu.Unlock()
+		if time.Now().After(deadline) {
+			return 0, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Write принимает команды и PDU и готовит на них ответы
+func (s *Simulator) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrSimulatorClosed
+	}
+	if s.echo {
+		s.output.Write(b)
+	}
+	s.input.Write(b)
+	s.process()
+	return len(b), nil
+}
+
+func (s *Simulator) Flush() error {
+	return nil
+}
+
+func (s *Simulator) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// Fail следующие count команд, начинающихся с prefix, получат response вместо обычного ответа
+func (s *Simulator) Fail(prefix, response string, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &simulatedFault{prefix: prefix, response: response, count: count})
+}
+
+// FailCMS следующие count команд с prefix завершатся +CMS ERROR: code
+func (s *Simulator) FailCMS(prefix string, code, count int) {
+	s.Fail(prefix, fmt.Sprintf("\r\n+CMS ERROR: %d\r\n", code), count)
+}
+
+// Timeout следующие count команд с prefix останутся без ответа
+func (s *Simulator) Timeout(prefix string, count int) {
+	s.Fail(prefix, "", count)
+}
+
+// reopen позволяет подключиться к симулятору заново после Close
+func (s *Simulator) reopen() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = false
+	s.input.Reset()
+	s.output.Reset()
+	s.pduLength = 0
+}
+
+// Sent сообщения, принятые через AT+CMGS
+func (s *Simulator) Sent() []SimulatedSMS {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SimulatedSMS(nil), s.sent...)
+}
+
+// Commands все полученные команды по порядку
+func (s *Simulator) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commandLog...)
+}
+
+// Receive кладет входящее сообщение в память модема и сообщает о нем через +CMTI.
+// Длинный текст разбивается на части с UDH, как это делает телефон отправителя.
+func (s *Simulator) Receive(sender, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reference++
+	for _, pdu := range buildDeliverPDUs(sender, text, uint16(s.reference), time.Now()) {
+		index := s.store(pdu)
+		s.output.WriteString(fmt.Sprintf("\r\n+CMTI: \"SM\",%d\r\n", index))
+	}
+}
+
+func (s *Simulator) store(pdu string) int {
+	s.nextIndex++
+	s.storage[s.nextIndex] = pdu
+	return s.nextIndex
+}
+
+// process разбирает накопленный ввод: команды до \r или PDU до Ctrl-Z
+func (s *Simulator) process() {
+	for {
+		data := s.input.Bytes()
+		if s.pduLength > 0 {
+			end := bytes.IndexByte(data, ctrlZ)
+			if cancel := bytes.IndexByte(data, escape); cancel >= 0 && (end < 0 || cancel < end) {
+				s.input.Next(cancel + 1)
+				s.pduLength = 0
+				s.output.WriteString(simulatedOK)
+				continue
+			}
+			if end < 0 {
+				return
+			}
+			pdu := strings.TrimSpace(string(data[:end]))
+			s.input.Next(end + 1)
+			s.acceptPDU(pdu)
+			continue
+		}
+
+		end := bytes.IndexByte(data, '\r')
+		if end < 0 {
+			return
+		}
+		command := strings.Trim(string(data[:end]), " \t\r\n\x1b")
+		s.input.Next(end + 1)
+		if command == "" {
+			continue
+		}
+		s.commandLog = append(s.commandLog, command)
+		if s.injectFault(command) {
+			continue
+		}
+		s.output.WriteString(s.execute(command))
+	}
+}
+
+// injectFault применяет подходящую подмену ответа, true если команда обработана
+func (s *Simulator) injectFault(command string) bool {
+	for i, fault := range s.faults {
+		if !strings.HasPrefix(command, fault.prefix) {
+			continue
+		}
+		fault.count--
+		if fault.count <= 0 {
+			s.faults = append(s.faults[:i], s.faults[i+1:]...)
+		}
+		s.output.WriteString(fault.response)
+		return true
+	}
+	return false
+}
+
+var simulatedCMGS = regexp.MustCompile(`^AT\+CMGS=(\d+)$`)
+var simulatedIndex = regexp.MustCompile(`^AT\+CMG[RD]=(\d+)`)
+var simulatedCUSD = regexp.MustCompile(`^AT\+CUSD=1,"([^"]*)"`)
+
+const simulatedOK = "\r\nOK\r\n"
+
+// execute отвечает на одну AT команду
+func (s *Simulator) execute(command string) string {
+	upper := strings.ToUpper(command)
+	switch {
+	case upper == "AT":
+		return simulatedOK
+	case upper == "ATE0":
+		s.echo = false
+		return simulatedOK
+	case upper == "ATE1":
+		s.echo = true
+		return simulatedOK
+	case strings.HasPrefix(upper, "AT+CMEE="),
+		strings.HasPrefix(upper, "AT+WIND="),
+		strings.HasPrefix(upper, "AT+CNMI="),
+		strings.HasPrefix(upper, "AT+CMGF="):
+		return simulatedOK
+	case simulatedCMGS.MatchString(upper):
+		if s.simState() != "READY" {
+			return "\r\n+CMS ERROR: 311\r\n"
+		}
+		s.pduLength, _ = strconv.Atoi(simulatedCMGS.FindStringSubmatch(upper)[1])
+		if s.pduLength <= 0 {
+			s.pduLength = 0
+			return "\r\n+CMS ERROR: 304\r\n"
+		}
+		return "\r\n> "
+	case upper == "AT+CPIN?":
+		return "\r\n+CPIN: " + s.simState() + "\r\n" + simulatedOK
+	case strings.HasPrefix(upper, "AT+CPIN="):
+		return s.enterPIN(strings.Trim(command[len("AT+CPIN="):], `"`))
+	case strings.HasPrefix(upper, "AT+CSCA="),
+		strings.HasPrefix(upper, "AT+CPMS="):
+		if s.simState() != "READY" {
+			return "\r\n+CMS ERROR: 311\r\n"
+		}
+		if strings.HasPrefix(upper, "AT+CPMS=") {
+			return fmt.Sprintf("\r\n+CPMS: %d,30,%d,30,%d,30\r\n", len(s.storage), len(s.storage), len(s.storage)) + simulatedOK
+		}
+		return simulatedOK
+	case upper == "AT+CUSD=2":
+		return simulatedOK
+	case simulatedCUSD.MatchString(command):
+		answer, ok := s.USSDAnswers[simulatedCUSD.FindStringSubmatch(command)[1]]
+		if !ok {
+			return simulatedOK + "\r\n+CUSD: 4\r\n"
+		}
+		return simulatedOK + fmt.Sprintf("\r\n+CUSD: 0,\"%s\",15\r\n", answer)
+	case upper == "AT+CGMI":
+		return "\r\ngosms simulator\r\n" + simulatedOK
+	case upper == "AT+CREG?":
+		return "\r\n+CREG: 0,1\r\n" + simulatedOK
+	case upper == "AT+CSQ":
+		return "\r\n+CSQ: 20,99\r\n" + simulatedOK
+	case upper == "AT+COPS?":
+		return "\r\n+COPS: 0,0,\"Simulator\",2\r\n" + simulatedOK
+	case upper == "AT+CGSN":
+		return "\r\n490154203237518\r\n" + simulatedOK
+	case upper == "AT+CIMI":
+		return "\r\n250029000000001\r\n" + simulatedOK
+	case upper == "AT+CCID":
+		return "\r\n+CCID: 89701020000000000019\r\n" + simulatedOK
+	case upper == "AT+CNUM":
+		return "\r\n+CNUM: \"\",\"+70000000000\",145\r\n" + simulatedOK
+	case upper == "AT+CBC":
+		return "\r\n+CBC: 0,100\r\n" + simulatedOK
+	case strings.HasPrefix(upper, "AT+CMGL"):
+		return s.list()
+	case strings.HasPrefix(upper, "AT+CMGR="):
+		index, _ := strconv.Atoi(simulatedIndex.FindStringSubmatch(upper)[1])
+		pdu, ok := s.storage[index]
+		if !ok {
+			return "\r\n+CMS ERROR: 321\r\n"
+		}
+		return fmt.Sprintf("\r\n+CMGR: 0,,%d\r\n%s\r\n\r\nOK\r\n", len(pdu)/2-1, pdu)
+	case strings.HasPrefix(upper, "AT+CMGD="):
+		index, _ := strconv.Atoi(simulatedIndex.FindStringSubmatch(upper)[1])
+		delete(s.storage, index)
+		return simulatedOK
+	}
+	log.Println("Simulator: unsupported command", command)
+	return "\r\nERROR\r\n"
+}
+
+// simState ответ AT+CPIN?
+func (s *Simulator) simState() string {
+	switch {
+	case s.PIN == "" || s.unlocked:
+		return "READY"
+	case s.pinErrors >= 3:
+		return "SIM PUK"
+	}
+	return "SIM PIN"
+}
+
+// enterPIN отвечает на AT+CPIN="<pin>"
+func (s *Simulator) enterPIN(pin string) string {
+	switch s.simState() {
+	case "READY":
+		return "\r\n+CME ERROR: 3\r\n"
+	case "SIM PUK":
+		return "\r\n+CME ERROR: 12\r\n"
+	}
+	if pin != s.PIN {
+		s.pinErrors++
+		return "\r\n+CME ERROR: 16\r\n"
+	}
+	s.unlocked = true
+	s.pinErrors = 0
+	return simulatedOK
+}
+
+// acceptPDU принимает PDU после приглашения AT+CMGS
+func (s *Simulator) acceptPDU(pdu string) {
+	length := s.pduLength
+	s.pduLength = 0
+	if len(pdu) < 2 || (len(pdu)-2)/2 != length {
+		s.output.WriteString("\r\n+CMS ERROR: 304\r\n")
+		return
+	}
+
+	s.reference = (s.reference + 1) % 256
+	s.sent = append(s.sent, SimulatedSMS{PDU: pdu, Reference: s.reference, SentAt: time.Now()})
+	s.output.WriteString(fmt.Sprintf("\r\n+CMGS: %d\r\n\r\nOK\r\n", s.reference))
+
+	// TP-SRR в первом октете после SMSC по умолчанию "00"
+	if firstOctet, err := strconv.ParseUint(pdu[2:4], 16, 8); s.StatusReports && err == nil && firstOctet&0x20 != 0 {
+		index := s.store(buildStatusReportPDU(s.reference, submitAddress(pdu[2:]), time.Now()))
+		s.output.WriteString(fmt.Sprintf("\r\n+CDSI: \"SR\",%d\r\n", index))
+	}
+}
+
+// list ответ на AT+CMGL в режиме PDU
+func (s *Simulator) list() string {
+	indexes := make([]int, 0, len(s.storage))
+	for index := range s.storage {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var out strings.Builder
+	for _, index := range indexes {
+		pdu := s.storage[index]
+		out.WriteString(fmt.Sprintf("\r\n+CMGL: %d,0,,%d\r\n%s", index, len(pdu)/2-1, pdu))
+	}
+	out.WriteString("\r\n" + simulatedOK)
+	return out.String()
+}
+
+// encodeTimestamp кодирует время в TP-SCTS
+func encodeTimestamp(t time.Time) string {
+	_, offset := t.Zone()
+	quarters := offset / (15 * 60)
+	sign := 0
+	if quarters < 0 {
+		quarters, sign = -quarters, 0x08
+	}
+	swap := func(v int) string {
+		return fmt.Sprintf("%d%d", v%10, v/10)
+	}
+	tz := fmt.Sprintf("%d%X", quarters%10, quarters/10|sign)
+	return swap(t.Year()%100) + swap(int(t.Month())) + swap(t.Day()) +
+		swap(t.Hour()) + swap(t.Minute()) + swap(t.Second()) + tz
+}
+
+// buildDeliverPDUs собирает SMS-DELIVER PDU входящего сообщения, как их хранит модем
+func buildDeliverPDUs(sender, text string, ref uint16, sentAt time.Time) []string {
+	var pdus []string
+	for _, submit := range buildSubmitPDUs(sender, text, submitOptions{ref: ref}) {
+		// SMS-SUBMIT: 00 FO MR DA PID DCS UDL UD, SMS-DELIVER: 00 FO OA PID DCS SCTS UDL UD
+		tpdu := submit.PDU[2:]
+		firstOctet, _ := strconv.ParseUint(tpdu[:2], 16, 8)
+		address := submitAddress(tpdu)
+		daEnd := 4 + len(address)
+		pidDCS := tpdu[daEnd : daEnd+4]
+		userData := tpdu[daEnd+4:]
+		deliverOctet := firstOctet&0x40 | 0x04 // UDHI, TP-MMS: больше сообщений нет
+		pdus = append(pdus, fmt.Sprintf("00%02X%s%s%s%s", deliverOctet, address, pidDCS, encodeTimestamp(sentAt), userData))
+	}
+	return pdus
+}
+
+// submitAddress адрес получателя (длина, тип, полуоктеты) из TPDU SMS-SUBMIT
+func submitAddress(tpdu string) string {
+	if len(tpdu) < 8 {
+		return ""
+	}
+	length, _ := strconv.ParseUint(tpdu[4:6], 16, 8)
+	end := 8 + int(length+1)/2*2
+	if end > len(tpdu) {
+		return ""
+	}
+	return tpdu[4:end]
+}
+
+// buildStatusReportPDU собирает SMS-STATUS-REPORT об успешной доставке
+func buildStatusReportPDU(reference int, address string, deliveredAt time.Time) string {
+	timestamp := encodeTimestamp(deliveredAt)
+	return fmt.Sprintf("0006%02X%s%s%s00", reference, address, timestamp, timestamp)
+}
@@ -0,0 +1,237 @@
+package modem
+
+import (
+	"context"
+	"gosms/transport"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingPort пишет в Simulator и запоминает все, что модем отправил в порт
+type recordingPort struct {
+	*Simulator
+	mu     sync.Mutex
+	writes []string
+}
+
+func (p *recordingPort) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	p.writes = append(p.writes, string(b))
+	p.mu.Unlock()
+	return p.Simulator.Write(b)
+}
+
+func (p *recordingPort) wrote(data string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, w := range p.writes {
+		if w == data {
+			return true
+		}
+	}
+	return false
+}
+
+func connectSimulator(t *testing.T) (*GSMModem, *recordingPort) {
+	t.Helper()
+	port := &recordingPort{Simulator: NewSimulator()}
+	port.ReadTimeout = 50 * time.Millisecond
+	m := NewWithPort("sim0", port)
+	if err := m.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { port.Close() })
+	return m, port
+}
+
+// sentText собирает текст из частей, принятых симулятором
+func sentText(t *testing.T, sim *Simulator) string {
+	var text string
+	for _, sms := range sim.Sent() {
+		text += submitUserData(t, sms.PDU).Text
+	}
+	return text
+}
+
+func TestSimulatorSend(t *testing.T) {
+	m, port := connectSimulator(t)
+
+	result, err := m.Send(context.Background(), transport.Message{To: "+79001234567", Body: "hello"})
+	if err != nil || result.Status != transport.StatusSent {
+		t.Fatalf("Send = %v, %v", result.Status, err)
+	}
+	if len(result.Parts) != 1 || result.Parts[0].Reference != 1 {
+		t.Errorf("parts %+v, want one part with reference 1", result.Parts)
+	}
+	if !port.wrote("AT+CMGS=18\r") {
+		t.Errorf("no AT+CMGS with the TPDU length, commands %v", port.Commands())
+	}
+	// PDU уходит только после приглашения "> " и заканчивается Ctrl-Z
+	if got := sentText(t, port.Simulator); got != "hello" {
+		t.Errorf("simulator got %q", got)
+	}
+}
+
+func TestSimulatorSendMultipart(t *testing.T) {
+	m, port := connectSimulator(t)
+
+	text := strings.Repeat("Длинное сообщение. ", 8)
+	sent := m.SendSMS("+79001234567", text)
+	if sent.Status() != SMSStatusOk {
+		t.Fatalf("status %s, parts %+v", sent.Status(), sent.Parts)
+	}
+	if len(sent.Parts) != 3 {
+		t.Fatalf("%d parts, want 3", len(sent.Parts))
+	}
+	for i, part := range sent.Parts {
+		if part.Part != i+1 || part.Reference != i+1 {
+			t.Errorf("part %d: %+v", i+1, part)
+		}
+	}
+	if got := sentText(t, port.Simulator); got != text {
+		t.Errorf("simulator got %q", got)
+	}
+}
+
+func TestSimulatorCMSError(t *testing.T) {
+	m, port := connectSimulator(t)
+	port.FailCMS("AT+CMGS", 21, 1)
+
+	result, err := m.Send(context.Background(), transport.Message{To: "+79001234567", Body: "hello"})
+	// 21 - SMSC отверг сообщение, повтор не поможет
+	if result.Status == transport.StatusSent || !transport.IsPermanent(err) {
+		t.Errorf("Send = %v, %v; want a permanent error", result.Status, err)
+	}
+	if permanent, ok := err.(*transport.PermanentError); !ok || !isCMSError(permanent.Err, 21) {
+		t.Errorf("error %#v, want *CMSError 21", err)
+	}
+	if len(result.Parts) != 1 || result.Parts[0].Reference != -1 {
+		t.Errorf("parts %+v", result.Parts)
+	}
+	if len(port.Sent()) != 0 {
+		t.Errorf("simulator accepted %d messages", len(port.Sent()))
+	}
+
+	// 331 - нет сети, можно повторить
+	port.FailCMS("AT+CMGS", 331, 1)
+	if _, err := m.Send(context.Background(), transport.Message{To: "+79001234567", Body: "hello"}); !isCMSError(err, 331) || transport.IsPermanent(err) {
+		t.Errorf("CMS 331: %v, want a temporary *CMSError", err)
+	}
+
+	port.Fail("AT+CMGS", "\r\n+CME ERROR: 10\r\n", 1)
+	sent := m.SendSMS("+79001234567", "hello")
+	if cme, ok := sent.Parts[0].Err.(*CMEError); !ok || cme.Code != 10 || sent.Parts[0].Code != 10 {
+		t.Errorf("CME 10: part %+v", sent.Parts[0])
+	}
+
+	sent = m.SendSMS("+79001234567", "hello")
+	if sent.Status() != SMSStatusOk {
+		t.Errorf("the fault is injected once, next send %s", sent.Status())
+	}
+}
+
+func isCMSError(err error, code int) bool {
+	cms, ok := err.(*CMSError)
+	return ok && cms.Code == code
+}
+
+func TestSimulatorInvalidNumber(t *testing.T) {
+	m, port := connectSimulator(t)
+	for _, to := range []string{"", "+"} {
+		result, err := m.Send(context.Background(), transport.Message{To: to, Body: "hello"})
+		if result.Status != transport.StatusFailed || err != ErrInvalidNumber {
+			t.Errorf("Send to %q = %v, %v; want failure", to, result.Status, err)
+		}
+	}
+	if len(port.Sent()) != 0 {
+		t.Errorf("simulator accepted %d messages", len(port.Sent()))
+	}
+}
+
+func TestSimulatorReceive(t *testing.T) {
+	m, port := connectSimulator(t)
+	port.StatusReports = true
+	m.StatusReport = true
+
+	text := strings.Repeat("Ответ клиента. ", 10)
+	port.Receive("+79007654321", "hi")
+	port.Receive("+79007654321", text)
+	sent := m.SendSMS("+79001234567", "hello")
+
+	inbound, reports, err := m.ReadMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inbound) != 2 || inbound[0].Body != "hi" || inbound[1].Body != text || inbound[1].Sender != "+79007654321" {
+		t.Fatalf("inbound %+v", inbound)
+	}
+	if len(inbound[1].Indexes) != 3 {
+		t.Errorf("multipart indexes %v, want 3", inbound[1].Indexes)
+	}
+	if len(reports) != 1 || reports[0].Reference != sent.Parts[0].Reference || !reports[0].Delivered() {
+		t.Errorf("reports %+v", reports)
+	}
+}
+
+func TestSimulatorTimeoutSendsEscape(t *testing.T) {
+	m, port := connectSimulator(t)
+	port.Timeout("AT+CMGS", 1)
+
+	// приглашение не пришло, PDU не передавался: сообщение точно не ушло
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	result, err := m.Send(ctx, transport.Message{To: "+79001234567", Body: "hello"})
+	if result.Status != transport.StatusFailed || err == nil {
+		t.Errorf("Send = %+v, %v; want failed", result, err)
+	}
+	if !port.wrote(string(rune(escape))) {
+		t.Error("ESC was not sent after the prompt timed out")
+	}
+
+	// модем не остался ждать PDU
+	if sent := m.SendSMS("+79001234567", "hello"); sent.Status() != SMSStatusOk {
+		t.Errorf("send after timeout %s: %+v", sent.Status(), sent.Parts)
+	}
+	if got := sentText(t, port.Simulator); got != "hello" {
+		t.Errorf("simulator got %q", got)
+	}
+}
+
+func TestTransportStatus(t *testing.T) {
+	tests := map[string]transport.Status{
+		SMSStatusOk:    transport.StatusSent,
+		SMSStatusError: transport.StatusFailed,
+		// ответа на PDU нет, сообщение могло уйти
+		"": transport.StatusUnknown,
+	}
+	for status, want := range tests {
+		if got := transportStatus(status); got != want {
+			t.Errorf("transportStatus(%q) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestSimulatorFaultInjection(t *testing.T) {
+	m, port := connectSimulator(t)
+
+	port.Fail("AT+CMGS", "\r\nERROR\r\n", 1)
+	if sent := m.SendSMS("+79001234567", "hello"); sent.Status() == SMSStatusOk {
+		t.Errorf("Fail: status %s", sent.Status())
+	}
+
+	port.Timeout("AT+CMGS", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if sent := m.SendSMSContext(ctx, "+79001234567", "hello"); sent.Status() == SMSStatusOk {
+		t.Errorf("Timeout: status %s", sent.Status())
+	}
+
+	if sent := m.SendSMS("+79001234567", "hello"); sent.Status() != SMSStatusOk {
+		t.Errorf("after faults: status %s", sent.Status())
+	}
+	if len(port.Sent()) != 1 {
+		t.Errorf("simulator accepted %d messages, want 1", len(port.Sent()))
+	}
+}
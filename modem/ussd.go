@@ -0,0 +1,128 @@
+package modem
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+)
+
+// USSDTimeout сколько ждать ответа сети на USSD запрос после OK
+var USSDTimeout = 30 * time.Second
+
+var cusdAnswer = regexp.MustCompile(`^\+CUSD:\s*(\d)(?:\s*,\s*"([^"]*)"(?:\s*,\s*(\d+))?)?`)
+
+// ussdStatuses значения <m> из +CUSD, при которых ответа может не быть (3GPP 27.007 7.15)
+var ussdStatuses = map[string]string{
+	"2": "terminated by network",
+	"3": "other local client has responded",
+	"4": "operation not supported",
+	"5": "network time out",
+}
+
+// USSD отправляет запрос, например *100#, и возвращает расшифрованный ответ сети.
+// Если сеть ждет продолжения диалога, он завершается
+func (m *GSMModem) USSD(code string) (string, error) {
+	log.Println("--- USSD ", m.DeviceId, code)
+	m.session.Lock()
+	defer m.session.Unlock()
+
+	request := code
+	if m.Info().Vendor == VendorHuawei {
+		// модемы Huawei принимают запрос только упакованными септетами в hex
+		if septets, ok := encodeGSM7(code); ok {
+			request = strings.ToUpper(hex.EncodeToString(packSeptets(septets, 0)))
+		}
+	}
+	// ответ сети приходит уже после OK
+	urcs, unsubscribe := m.Subscribe("+CUSD")
+	defer unsubscribe()
+	if _, err := m.command(fmt.Sprintf("AT+CUSD=1,\"%s\",15\r", request)); err != nil {
+		return "", err
+	}
+	var line string
+	select {
+	case urc := <-urcs:
+		line = urc.Line
+	case <-m.reader.done:
+		return "", ErrPortClosed
+	case <-time.After(USSDTimeout):
+		return "", ErrTimeout
+	}
+	match := cusdAnswer.FindStringSubmatch(line)
+	if match == nil {
+		return "", fmt.Errorf("unexpected USSD answer: %s", line)
+	}
+
+	if match[1] == "1" {
+		if _, err := m.command("AT+CUSD=2\r"); err != nil {
+			log.Println("USSD: ", m.DeviceId, "closing session:", err)
+		}
+	}
+	if status, ok := ussdStatuses[match[1]]; ok && match[2] == "" {
+		return "", fmt.Errorf("USSD %s: %s", code, status)
+	}
+	dcs := 15
+	if match[3] != "" {
+		dcs, _ = strconv.Atoi(match[3])
+	}
+	return decodeUSSD(match[2], dcs), nil
+}
+
+// decodeUSSD текст ответа +CUSD. В зависимости от модема, AT+CSCS и схемы кодирования
+// он приходит как есть, как hex упакованных септетов GSM 7 (Huawei) или как hex UCS-2
+func decodeUSSD(text string, dcs int) string {
+	if len(text) < 4 || strings.Trim(text, "0123456789") == "" {
+		// короткий или только из цифр ответ скорее всего уже текст
+		return text
+	}
+	data, err := hex.DecodeString(text)
+	if err != nil {
+		return text
+	}
+
+	// 0x48 и вообще 0100xx10 - UCS-2, 0x11 - UCS-2 с двумя символами языка впереди (3GPP 23.038 5)
+	if dcs == 0x11 && len(data) >= 2 {
+		return decodeUCS2(data[2:])
+	}
+	if dcs&0xCC == 0x48 {
+		return decodeUCS2(data)
+	}
+	if decoded := decodeUCS2(data); len(data)%2 == 0 && likelyUCS2(decoded) {
+		return decoded
+	}
+
+	septets := unpackSeptets(data, len(data)*8/7, 0)
+	// 7 свободных бит в конце заполняются символом CR, а не @
+	if len(data)%7 == 0 && len(septets) > 0 && septets[len(septets)-1] == '\r' {
+		septets = septets[:len(septets)-1]
+	}
+	return decodeGSM7(septets)
+}
+
+func decodeUCS2(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+// likelyUCS2 текст похож на ответ оператора: латиница, кириллица и знаки препинания,
+// а не случайные символы, которые получаются из упакованных септетов
+func likelyUCS2(text string) bool {
+	for _, r := range text {
+		if r == '\n' || r == '\r' {
+			continue
+		}
+		if !unicode.IsPrint(r) || (r >= 0x0530 && (r < 0x2000 || r > 0x20CF)) {
+			return false
+		}
+	}
+	return text != ""
+}
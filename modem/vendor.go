@@ -0,0 +1,91 @@
+package modem
+
+import (
+	"strconv"
+	"strings"
+)
+
+// производители модемов, для которых известны команды инициализации
+const (
+	VendorUnknown = ""
+	VendorHuawei  = "huawei"
+	VendorZTE     = "zte"
+	VendorSIMCom  = "simcom"
+	VendorQuectel = "quectel"
+	VendorSierra  = "sierra"
+)
+
+// vendorProfile команды и настройки по умолчанию для модемов одного производителя
+type vendorProfile struct {
+	// InitCommands выполняются после ATE0 и AT+CMEE=1, до настроек устройства
+	InitCommands []string
+	// Storage память сообщений для AT+CPMS, если STORAGE не задан
+	Storage string
+}
+
+var vendorProfiles = map[string]vendorProfile{
+	// ^RSSI, ^MODE, ^BOOT и прочие периодические уведомления мешают разбирать ответы
+	VendorHuawei: {InitCommands: []string{"AT^CURC=0"}, Storage: "SM"},
+	// включить радиочасть, модемы MF часто стартуют в режиме offline
+	VendorZTE: {InitCommands: []string{"AT+ZOPRT=5"}, Storage: "SM"},
+	// без спящего режима модем теряет первые символы команд
+	VendorSIMCom: {InitCommands: []string{"AT+CSCLK=0"}, Storage: "SM"},
+	// уведомления в тот же порт, на котором работают AT команды
+	VendorQuectel: {InitCommands: []string{`AT+QURCCFG="urcport","usbat"`}, Storage: "ME"},
+	VendorSierra:  {InitCommands: []string{"AT+WIND=0"}, Storage: "SM"},
+}
+
+// vendorNames подстроки ответа AT+CGMI или ATI и соответствующий производитель
+var vendorNames = []struct {
+	substring string
+	vendor    string
+}{
+	{"huawei", VendorHuawei},
+	{"zte", VendorZTE},
+	{"simcom", VendorSIMCom},
+	{"quectel", VendorQuectel},
+	{"sierra", VendorSierra},
+	// Sierra Wireless купила Wavecom, модемы отвечают по-прежнему
+	{"wavecom", VendorSierra},
+}
+
+// detectVendor производитель по ответу AT+CGMI или ATI, VendorUnknown если он не распознан
+func detectVendor(output string) string {
+	output = strings.ToLower(output)
+	for _, name := range vendorNames {
+		if strings.Contains(output, name.substring) {
+			return name.vendor
+		}
+	}
+	return VendorUnknown
+}
+
+// ParseVendor проверяет значение VENDOR из конфигурации
+func ParseVendor(vendor string) (string, bool) {
+	vendor = strings.ToLower(strings.TrimSpace(vendor))
+	_, ok := vendorProfiles[vendor]
+	return vendor, ok
+}
+
+// storageCommand AT+CPMS для "SM" или "SM,SM,ME": одна память для всего или
+// отдельно для чтения, записи и приема
+func storageCommand(storage string) string {
+	var memories []string
+	for _, memory := range strings.Split(storage, ",") {
+		memories = append(memories, `"`+strings.ToUpper(strings.TrimSpace(memory))+`"`)
+	}
+	for len(memories) < 3 {
+		memories = append(memories, memories[len(memories)-1])
+	}
+	return "AT+CPMS=" + strings.Join(memories, ",")
+}
+
+// smscCommand AT+CSCA с типом номера: 145 международный, 129 остальные
+func smscCommand(smsc string) string {
+	smsc = strings.TrimSpace(smsc)
+	numberType := 129
+	if strings.HasPrefix(smsc, "+") {
+		numberType = 145
+	}
+	return "AT+CSCA=\"" + smsc + "\"," + strconv.Itoa(numberType)
+}
@@ -0,0 +1,95 @@
+package gosms
+
+import (
+	"gosms/modem"
+	"gosms/transport"
+	"log"
+	"time"
+)
+
+// RateLimit ограничения отправки одного устройства, 0 - без ограничения.
+// Считаются части SMS, оператор тарифицирует и блокирует именно их.
+type RateLimit struct {
+	PerMinute    int
+	PerHour      int
+	PerDay       int
+	MonthlyQuota int
+}
+
+// RateLimits ограничения по идентификатору устройства (DEVID)
+var RateLimits = map[string]RateLimit{}
+
+// rateWindows скользящие окна ограничений
+var rateWindows = []struct {
+	window time.Duration
+	limit  func(RateLimit) int
+}{
+	{time.Minute, func(l RateLimit) int { return l.PerMinute }},
+	{time.Hour, func(l RateLimit) int { return l.PerHour }},
+	{24 * time.Hour, func(l RateLimit) int { return l.PerDay }},
+}
+
+// rateLimitWait сколько устройство должно ждать, чтобы отправить еще parts частей, 0 если можно сейчас.
+// Сообщение длиннее самого лимита ждет, пока окно не опустеет, иначе оно не уйдет никогда
+func rateLimitWait(device string, parts int) time.Duration {
+	limit, ok := RateLimits[device]
+	if !ok {
+		return 0
+	}
+	now := time.Now().UTC()
+
+	if limit.MonthlyQuota > 0 {
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		used, _, err := getDeviceUsage(device, monthStart)
+		if err == nil && used > 0 && used+parts > limit.MonthlyQuota {
+			log.Println("rateLimitWait: ", device, "monthly quota used", used, "need", parts)
+			return monthStart.AddDate(0, 1, 0).Sub(now)
+		}
+	}
+
+	var wait time.Duration
+	for _, w := range rateWindows {
+		max := w.limit(limit)
+		if max <= 0 {
+			continue
+		}
+		used, oldest, err := getDeviceUsage(device, now.Add(-w.window))
+		if err != nil || used == 0 || used+parts <= max {
+			continue
+		}
+		// окно сдвинется за самую раннюю отправку в нем
+		if until := oldest.Add(w.window).Sub(now); until > wait {
+			wait = until
+		}
+	}
+	if wait > 0 {
+		// отправки в пределах одной секунды получают одну метку времени
+		wait += time.Second
+	}
+	return wait
+}
+
+// messageParts сколько частей займет сообщение, для каналов без частей - одна
+func messageParts(t transport.Transport, body string) int {
+	if gsmModem, isModem := t.(*modem.GSMModem); isModem {
+		return modem.Estimate(body, gsmModem.ConcatRef16).Segments
+	}
+	return 1
+}
+
+// sentParts сколько частей ушло в сеть, для каналов без частей - само сообщение
+func sentParts(result transport.Result) int {
+	if len(result.Parts) == 0 {
+		if result.Status == transport.StatusSent {
+			return 1
+		}
+		return 0
+	}
+	count := 0
+	for _, part := range result.Parts {
+		if part.Status == transport.StatusSent {
+			count++
+		}
+	}
+	return count
+}
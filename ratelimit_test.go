@@ -0,0 +1,91 @@
+package gosms
+
+import (
+	"gosms/modem"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useDevice записывает отправку parts частей устройством ago назад
+func useDevice(t *testing.T, device string, parts int, ago time.Duration) {
+	t.Helper()
+	_, err := db.Exec("INSERT INTO device_usage(device, parts, sent_at) VALUES(?, ?, ?)",
+		device, parts, time.Now().UTC().Add(-ago).Format(timeFormat))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setRateLimit(t *testing.T, device string, limit RateLimit) {
+	limits := RateLimits
+	RateLimits = map[string]RateLimit{device: limit}
+	t.Cleanup(func() { RateLimits = limits })
+}
+
+func TestRateLimitWindows(t *testing.T) {
+	setupWorker(t)
+	setRateLimit(t, "sim0", RateLimit{PerMinute: 5, PerHour: 20})
+
+	if wait := rateLimitWait("other", 100); wait != 0 {
+		t.Errorf("device without limits waits %v", wait)
+	}
+	useDevice(t, "sim0", 3, 30*time.Second)
+	if wait := rateLimitWait("sim0", 2); wait != 0 {
+		t.Errorf("3+2 of 5 per minute: wait %v", wait)
+	}
+	// сообщение из трех частей не помещается в остаток минуты, ждет, пока окно сдвинется
+	if wait := rateLimitWait("sim0", 3); wait < 29*time.Second || wait > 32*time.Second {
+		t.Errorf("3+3 of 5 per minute: wait %v, want about 31s", wait)
+	}
+
+	// в минутном окне еще есть место, но часовое заполнено
+	useDevice(t, "sim0", 17, 30*time.Minute)
+	if wait := rateLimitWait("sim0", 1); wait < 29*time.Minute || wait > 31*time.Minute {
+		t.Errorf("20+1 of 20 per hour: wait %v, want about 30m", wait)
+	}
+}
+
+func TestRateLimitOversized(t *testing.T) {
+	setupWorker(t)
+	setRateLimit(t, "sim0", RateLimit{PerMinute: 2})
+
+	// сообщение длиннее лимита уходит только в пустое окно
+	if wait := rateLimitWait("sim0", 3); wait != 0 {
+		t.Errorf("empty window: wait %v", wait)
+	}
+	useDevice(t, "sim0", 1, 10*time.Second)
+	if wait := rateLimitWait("sim0", 3); wait == 0 {
+		t.Errorf("oversized message sent into a used window")
+	}
+}
+
+func TestRateLimitMonthlyQuota(t *testing.T) {
+	setupWorker(t)
+	setRateLimit(t, "sim0", RateLimit{MonthlyQuota: 10})
+
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	// отправки прошлого месяца в квоту не входят
+	useDevice(t, "sim0", 100, now.Sub(monthStart)+time.Hour)
+	useDevice(t, "sim0", 8, 0)
+
+	if wait := rateLimitWait("sim0", 2); wait != 0 {
+		t.Errorf("8+2 of 10: wait %v", wait)
+	}
+	nextMonth := monthStart.AddDate(0, 1, 0)
+	wait := rateLimitWait("sim0", 3)
+	if until := now.Add(wait); until.Before(nextMonth.Add(-time.Minute)) || until.After(nextMonth.Add(time.Minute)) {
+		t.Errorf("8+3 of 10: wait until %v, want %v", until, nextMonth)
+	}
+}
+
+func TestMessageParts(t *testing.T) {
+	gsmModem := modem.NewWithPort("sim0", modem.NewSimulator())
+	if parts := messageParts(gsmModem, strings.Repeat("привет ", 20)); parts != 3 {
+		t.Errorf("modem: %d parts, want 3", parts)
+	}
+	if parts := messageParts(&fakeTransport{id: "telegram"}, strings.Repeat("привет ", 20)); parts != 1 {
+		t.Errorf("telegram: %d parts, want 1", parts)
+	}
+}
@@ -0,0 +1,140 @@
+package gosms
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// каналы доставки
+const (
+	ChannelSMS      = "sms"
+	ChannelTelegram = "telegram"
+	ChannelWhatsApp = "whatsapp"
+)
+
+// RouteAll отправка сразу во все каналы
+const RouteAll = "all"
+
+// DefaultRoute политика для запросов и пользователей без своей политики
+var DefaultRoute = RouteAll
+
+var allChannels = []string{ChannelTelegram, ChannelWhatsApp, ChannelSMS}
+
+// RouteStep канал и сколько ждать доставки через него, прежде чем перейти к следующему.
+// Wait = 0 - переходить к следующему каналу только если отправка не удалась.
+type RouteStep struct {
+	Channel string
+	Wait    time.Duration
+}
+
+// Route политика доставки сообщения, например "telegram:10,sms" -
+// сначала Telegram, через 10 минут без доставки - SMS
+type Route struct {
+	All   bool
+	Steps []RouteStep
+}
+
+// ParseRoute разбирает политику: "all", "sms" или каналы через запятую с ожиданием в минутах
+func ParseRoute(s string) (Route, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return Route{}, errors.New("route is empty")
+	}
+	if s == RouteAll {
+		route := Route{All: true}
+		for _, channel := range allChannels {
+			route.Steps = append(route.Steps, RouteStep{Channel: channel})
+		}
+		return route, nil
+	}
+
+	var route Route
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		step := RouteStep{Channel: parts[0]}
+		if !isChannel(step.Channel) {
+			return Route{}, fmt.Errorf("unknown channel %q", step.Channel)
+		}
+		if seen[step.Channel] {
+			return Route{}, fmt.Errorf("channel %q is used twice", step.Channel)
+		}
+		seen[step.Channel] = true
+		if len(parts) == 2 {
+			minutes, err := strconv.Atoi(parts[1])
+			if err != nil || minutes < 0 {
+				return Route{}, fmt.Errorf("invalid wait %q for channel %q", parts[1], step.Channel)
+			}
+			step.Wait = time.Duration(minutes) * time.Minute
+		}
+		route.Steps = append(route.Steps, step)
+	}
+	return route, nil
+}
+
+func isChannel(channel string) bool {
+	for _, c := range allChannels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Route) String() string {
+	if r.All {
+		return RouteAll
+	}
+	steps := make([]string, 0, len(r.Steps))
+	for _, step := range r.Steps {
+		if step.Wait > 0 {
+			steps = append(steps, fmt.Sprintf("%s:%d", step.Channel, int(step.Wait/time.Minute)))
+		} else {
+			steps = append(steps, step.Channel)
+		}
+	}
+	return strings.Join(steps, ",")
+}
+
+// Legs независимые ветки доставки: для "all" по одной на канал, иначе сама политика
+func (r Route) Legs() []Route {
+	if !r.All {
+		return []Route{r}
+	}
+	legs := make([]Route, 0, len(r.Steps))
+	for _, step := range r.Steps {
+		legs = append(legs, Route{Steps: []RouteStep{step}})
+	}
+	return legs
+}
+
+// step шаг политики для канала, -1 если канала в политике нет
+func (r Route) step(channel string) int {
+	for i, step := range r.Steps {
+		if step.Channel == channel {
+			return i
+		}
+	}
+	return -1
+}
+
+// next канал после channel, пустая строка если это последний шаг
+func (r Route) next(channel string) string {
+	i := r.step(channel)
+	if i < 0 || i+1 >= len(r.Steps) {
+		return ""
+	}
+	return r.Steps[i+1].Channel
+}
+
+// wait сколько ждать доставки через channel перед переходом к следующему каналу
+func (r Route) wait(channel string) time.Duration {
+	i := r.step(channel)
+	if i < 0 || i+1 >= len(r.Steps) {
+		return 0
+	}
+	return r.Steps[i].Wait
+}
@@ -0,0 +1,93 @@
+package gosms
+
+import (
+	"fmt"
+	"time"
+)
+
+// timeFormat формат времени в базе, всегда UTC
+const timeFormat = "2006-01-02 15:04:05"
+
+// QuietHours период суток, когда рекламные сообщения не отправляются,
+// считается в часовом поясе получателя. Start > End означает период через полночь.
+type QuietHours struct {
+	Start time.Duration // от полуночи
+	End   time.Duration
+}
+
+// Quiet тихие часы для рекламных сообщений, нулевое значение - без ограничений
+var Quiet QuietHours
+
+// DefaultTimezone часовой пояс получателей, у которых он не указан
+var DefaultTimezone = time.Local
+
+// ParseQuietHours разбирает период вида "22:00-08:00"
+func ParseQuietHours(s string) (QuietHours, error) {
+	var startH, startM, endH, endM int
+	if _, err := fmt.Sscanf(s, "%d:%d-%d:%d", &startH, &startM, &endH, &endM); err != nil {
+		return QuietHours{}, fmt.Errorf("invalid quiet hours %q, expected HH:MM-HH:MM", s)
+	}
+	if startH < 0 || startH > 23 || endH < 0 || endH > 23 || startM < 0 || startM > 59 || endM < 0 || endM > 59 {
+		return QuietHours{}, fmt.Errorf("invalid quiet hours %q", s)
+	}
+	return QuietHours{
+		Start: time.Duration(startH)*time.Hour + time.Duration(startM)*time.Minute,
+		End:   time.Duration(endH)*time.Hour + time.Duration(endM)*time.Minute,
+	}, nil
+}
+
+// Enabled тихие часы заданы
+func (q QuietHours) Enabled() bool {
+	return q.Start != q.End
+}
+
+// Until если t попадает в тихие часы, возвращает их окончание
+func (q QuietHours) Until(t time.Time) (time.Time, bool) {
+	if !q.Enabled() {
+		return t, false
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	sinceMidnight := t.Sub(midnight)
+
+	if q.Start < q.End {
+		if sinceMidnight >= q.Start && sinceMidnight < q.End {
+			return midnight.Add(q.End), true
+		}
+		return t, false
+	}
+	// через полночь, например 22:00-08:00
+	if sinceMidnight >= q.Start {
+		return midnight.AddDate(0, 0, 1).Add(q.End), true
+	}
+	if sinceMidnight < q.End {
+		return midnight.Add(q.End), true
+	}
+	return t, false
+}
+
+// ParseSendAt разбирает время отложенной отправки в RFC3339 и переводит в формат базы
+func ParseSendAt(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return "", fmt.Errorf("invalid send_at %q, expected RFC3339 e.g. 2006-01-02T15:04:05+03:00", s)
+	}
+	return t.UTC().Format(timeFormat), nil
+}
+
+// userLocation часовой пояс получателя
+func userLocation(user *User) *time.Location {
+	if user != nil && user.Timezone != "" {
+		if location, err := time.LoadLocation(user.Timezone); err == nil {
+			return location
+		}
+	}
+	return DefaultTimezone
+}
+
+// quietUntil когда можно отправить рекламное сообщение получателю, false если можно сейчас
+func quietUntil(user *User, now time.Time) (time.Time, bool) {
+	return Quiet.Until(now.In(userLocation(user)))
+}
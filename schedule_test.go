@@ -0,0 +1,86 @@
+package gosms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseQuietHours(t *testing.T) {
+	q, err := ParseQuietHours("22:00-08:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Start != 22*time.Hour || q.End != 8*time.Hour+30*time.Minute {
+		t.Errorf("ParseQuietHours = %+v", q)
+	}
+	for _, s := range []string{"", "22-08", "24:00-08:00", "22:00-08:60"} {
+		if _, err := ParseQuietHours(s); err == nil {
+			t.Errorf("ParseQuietHours(%q) accepted", s)
+		}
+	}
+}
+
+func TestQuietHoursUntil(t *testing.T) {
+	day := func(h, m int) time.Time { return time.Date(2026, 3, 10, h, m, 0, 0, time.UTC) }
+	tests := []struct {
+		name  string
+		quiet string
+		at    time.Time
+		until time.Time
+		ok    bool
+	}{
+		{"same day, inside", "13:00-15:00", day(14, 0), day(15, 0), true},
+		{"same day, at end", "13:00-15:00", day(15, 0), day(15, 0), false},
+		{"same day, before", "13:00-15:00", day(12, 59), day(12, 59), false},
+		{"through midnight, evening", "22:00-08:00", day(23, 30), time.Date(2026, 3, 11, 8, 0, 0, 0, time.UTC), true},
+		{"through midnight, morning", "22:00-08:00", day(7, 59), day(8, 0), true},
+		{"through midnight, day", "22:00-08:00", day(12, 0), day(12, 0), false},
+		{"disabled", "00:00-00:00", day(12, 0), day(12, 0), false},
+	}
+	for _, tt := range tests {
+		q, err := ParseQuietHours(tt.quiet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		until, ok := q.Until(tt.at)
+		if ok != tt.ok || !until.Equal(tt.until) {
+			t.Errorf("%s: Until = %v, %v; want %v, %v", tt.name, until, ok, tt.until, tt.ok)
+		}
+	}
+}
+
+func TestQuietUntilTimezone(t *testing.T) {
+	quiet := Quiet
+	Quiet, _ = ParseQuietHours("22:00-08:00")
+	t.Cleanup(func() { Quiet = quiet })
+
+	// 20:00 UTC - это 23:00 в Москве, но еще не ночь в UTC
+	now := time.Date(2026, 3, 10, 20, 0, 0, 0, time.UTC)
+	until, ok := quietUntil(&User{Timezone: "Europe/Moscow"}, now)
+	if !ok || !until.Equal(time.Date(2026, 3, 11, 5, 0, 0, 0, time.UTC)) {
+		t.Errorf("Moscow: %v, %v", until.UTC(), ok)
+	}
+	if _, ok := quietUntil(&User{Timezone: "UTC"}, now); ok {
+		t.Errorf("UTC: quiet at 20:00")
+	}
+}
+
+func TestParseSendAt(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"", "", true},
+		{"2026-03-10T15:04:05+03:00", "2026-03-10 12:04:05", true},
+		{"2026-03-10T12:04:05Z", "2026-03-10 12:04:05", true},
+		{"2026-03-10 12:04:05", "", false},
+		{"tomorrow", "", false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSendAt(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseSendAt(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
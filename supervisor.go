@@ -0,0 +1,235 @@
+package gosms
+
+import (
+	"gosms/modem"
+	"gosms/transport"
+	"log"
+	"sync"
+	"time"
+)
+
+// ProbeInterval как часто проверять модемы (AT, AT+CPIN?, AT+CREG?, AT+CSQ)
+var ProbeInterval = time.Minute
+
+// ReconnectDelay пауза перед первой попыткой переподключения, каждая следующая
+// вдвое дольше, но не больше ReconnectMaxDelay
+var ReconnectDelay = 5 * time.Second
+var ReconnectMaxDelay = 5 * time.Minute
+
+// balanceRetryDelay пауза перед повтором неудачного запроса баланса
+var balanceRetryDelay = 10 * time.Minute
+
+// DeviceStatus состояние устройства для /api/devices/
+type DeviceStatus struct {
+	ID      string `json:"id"`
+	Channel string `json:"channel"`
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason"`
+	// CheckedAt время последней проверки, пусто для каналов без проверки
+	CheckedAt string `json:"checked_at"`
+	// Reconnects неудачных попыток переподключения подряд
+	Reconnects      int    `json:"reconnects"`
+	NextReconnectAt string `json:"next_reconnect_at"`
+	// Sent и Failed сообщений с этим устройством в messages.device
+	Sent   int `json:"sent"`
+	Failed int `json:"failed"`
+	// Info сведения о модеме и SIM, только для модемов
+	Info *modem.DeviceInfo `json:"info,omitempty"`
+	// Balance только для модемов с BALANCECODE
+	Balance *Balance `json:"balance,omitempty"`
+}
+
+// supervisor следит за одним устройством. Все его методы вызываются из
+// processMessages этого устройства, поэтому состояние меняет одна горутина;
+// мьютекс только для чтения состояния из API
+type supervisor struct {
+	transport transport.Transport
+	channel   string
+	modem     *modem.GSMModem
+
+	mu            sync.Mutex
+	checkedAt     time.Time
+	failures      int
+	nextReconnect time.Time
+	// balance последний ответ на запрос баланса, balanceDue время следующего запроса
+	balance    Balance
+	balanceDue time.Time
+	lowAlerted bool
+}
+
+var supervisorsMu sync.Mutex
+var supervisors []*supervisor
+
+func supervise(t transport.Transport, channel string) *supervisor {
+	s := &supervisor{transport: t, channel: channel}
+	s.modem, _ = t.(*modem.GSMModem)
+	if check, ok := BalanceChecks[t.ID()]; ok && s.modem != nil {
+		// последний баланс сохраняется между перезапусками, о низком не сообщаем повторно
+		s.balance, s.balanceDue = getLastBalance(t.ID())
+		if !s.balanceDue.IsZero() {
+			s.balance.Low = s.balance.Amount != nil && *s.balance.Amount < check.Low
+			s.lowAlerted = s.balance.Low
+			s.balanceDue = s.balanceDue.Add(check.interval())
+		}
+	}
+	supervisorsMu.Lock()
+	supervisors = append(supervisors, s)
+	supervisorsMu.Unlock()
+	return s
+}
+
+// healthy только модемы перестают получать сообщения, другие каналы сообщают об ошибке при отправке
+func (s *supervisor) healthy() bool {
+	return s.modem == nil || s.modem.Health().Healthy
+}
+
+func (s *supervisor) probe() {
+	if s.modem == nil {
+		return
+	}
+	err := s.modem.Probe()
+	if err == nil {
+		// только сведения, модем, прошедший Probe, может отправлять
+		if infoErr := s.modem.RefreshInfo(); infoErr != nil {
+			log.Println("supervisor: ", s.transport.ID(), "refreshing info:", infoErr)
+		}
+	}
+	s.mu.Lock()
+	s.checkedAt = time.Now()
+	if err != nil {
+		s.nextReconnect = s.checkedAt.Add(s.reconnectDelay())
+	}
+	s.mu.Unlock()
+}
+
+// untilReconnect сколько ждать следующей попытки переподключения
+func (s *supervisor) untilReconnect() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nextReconnect.IsZero() {
+		s.nextReconnect = time.Now().Add(s.reconnectDelay())
+	}
+	return time.Until(s.nextReconnect)
+}
+
+func (s *supervisor) reconnect() {
+	log.Println("supervisor: reconnecting", s.transport.ID())
+	err := s.modem.Reconnect()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkedAt = time.Now()
+	if err != nil {
+		s.failures++
+		s.nextReconnect = s.checkedAt.Add(s.reconnectDelay())
+		log.Println("supervisor: ", s.transport.ID(), "reconnect failed:", err, "next attempt at", s.nextReconnect)
+		return
+	}
+	log.Println("supervisor: ", s.transport.ID(), "is back")
+	s.failures = 0
+	s.nextReconnect = time.Time{}
+}
+
+// reconnectDelay вызывается под s.mu
+func (s *supervisor) reconnectDelay() time.Duration {
+	delay := ReconnectDelay
+	for i := 0; i < s.failures && delay < ReconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > ReconnectMaxDelay {
+		delay = ReconnectMaxDelay
+	}
+	return delay
+}
+
+// untilBalance сколько ждать следующего запроса баланса, false если он не настроен
+func (s *supervisor) untilBalance() (time.Duration, bool) {
+	if _, ok := BalanceChecks[s.transport.ID()]; !ok || s.modem == nil {
+		return 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Until(s.balanceDue), true
+}
+
+func (s *supervisor) checkBalance() {
+	id := s.transport.ID()
+	check := BalanceChecks[id]
+	response, err := s.modem.USSD(check.Code)
+	now := time.Now()
+	if err != nil {
+		log.Println("supervisor: ", id, "balance check failed:", err)
+		s.mu.Lock()
+		s.balance.Error = err.Error()
+		s.balanceDue = now.Add(balanceRetryDelay)
+		s.mu.Unlock()
+		return
+	}
+
+	balance := Balance{Response: response, CheckedAt: now.UTC().Format(timeFormat)}
+	if amount, err := ParseBalance(response, check.Pattern); err == nil {
+		balance.Amount = &amount
+		balance.Low = amount < check.Low
+	} else {
+		log.Println("supervisor: ", id, err)
+		balance.Error = err.Error()
+	}
+	recordBalance(id, balance.Amount, response)
+
+	s.mu.Lock()
+	s.balance = balance
+	s.balanceDue = now.Add(check.interval())
+	alert := balance.Low && !s.lowAlerted
+	if balance.Amount != nil {
+		s.lowAlerted = balance.Low
+	}
+	s.mu.Unlock()
+
+	if alert {
+		log.Println("supervisor: ", id, "balance is low:", *balance.Amount)
+		if OnLowBalance != nil {
+			OnLowBalance(id, *balance.Amount, response)
+		}
+	}
+}
+
+func (s *supervisor) status() DeviceStatus {
+	health := s.transport.Health()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := DeviceStatus{
+		ID:         s.transport.ID(),
+		Channel:    s.channel,
+		Healthy:    health.Healthy,
+		Reason:     health.Reason,
+		Reconnects: s.failures,
+	}
+	if !s.checkedAt.IsZero() {
+		status.CheckedAt = s.checkedAt.UTC().Format(timeFormat)
+	}
+	if !health.Healthy && !s.nextReconnect.IsZero() && s.modem != nil {
+		status.NextReconnectAt = s.nextReconnect.UTC().Format(timeFormat)
+	}
+	if s.modem != nil {
+		info := s.modem.Info()
+		status.Info = &info
+	}
+	if _, ok := BalanceChecks[s.transport.ID()]; ok && s.modem != nil {
+		balance := s.balance
+		status.Balance = &balance
+	}
+	return status
+}
+
+// Devices состояние всех устройств всех каналов
+func Devices() []DeviceStatus {
+	supervisorsMu.Lock()
+	defer supervisorsMu.Unlock()
+	counters, _ := getDeviceCounters()
+	devices := make([]DeviceStatus, 0, len(supervisors))
+	for _, s := range supervisors {
+		status := s.status()
+		status.Sent, status.Failed = counters[status.ID][0], counters[status.ID][1]
+		devices = append(devices, status)
+	}
+	return devices
+}
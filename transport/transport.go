@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNoRecipient получатель недоступен в этом канале, например не привязал номер в боте
+var ErrNoRecipient = errors.New("recipient is not available in this channel")
+
+// PermanentError отказ, который не исправится повторной отправкой: неверный номер, запрет оператора
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Permanent помечает ошибку как постоянную
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent повторять отправку бессмысленно
+func IsPermanent(err error) bool {
+	if err == ErrNoRecipient {
+		return true
+	}
+	_, ok := err.(*PermanentError)
+	return ok
+}
+
+// Status итог попытки отправки
+type Status string
+
+const (
+	StatusSent    Status = "sent"    // канал принял сообщение
+	StatusFailed  Status = "failed"  // канал отказал в отправке
+	StatusUnknown Status = "unknown" // ответа нет, например истек таймаут: сообщение могло уйти, повторять нельзя
+)
+
+// Message сообщение для отправки через любой канал
+type Message struct {
+	UUID string
+	To   string // номер телефона получателя в виде +71112223344
+	Body string
+}
+
+// Part результат отправки одной части составного сообщения
+type Part struct {
+	Part      int    `json:"part"`
+	Status    Status `json:"status"`
+	Reference int    `json:"reference"` // идентификатор части у провайдера, -1 если неизвестен
+}
+
+// Result результат отправки сообщения
+type Result struct {
+	Status     Status `json:"status"`
+	ProviderID string `json:"provider_id"` // идентификатор сообщения у провайдера
+	Parts      []Part `json:"parts"`
+}
+
+// Health состояние канала
+type Health struct {
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Transport канал доставки сообщений: GSM модем, Telegram, WhatsApp
+type Transport interface {
+	// ID идентификатор канала, для модема - DEVID
+	ID() string
+	// Send отправляет сообщение, ошибка означает, что сообщение не отправлено
+	Send(ctx context.Context, msg Message) (Result, error)
+	// Health текущее состояние канала
+	Health() Health
+}
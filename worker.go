@@ -1,21 +1,102 @@
 package gosms
 
 import (
+	"context"
+	"fmt"
+	"github.com/satori/go.uuid"
 	"gosms/modem"
+	"gosms/transport"
 	"log"
-	"strings"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-//TODO: should be configurable
-const SMSRetryLimit = 3
+// SMSRetryLimit попыток отправки в одном канале, RETRIES в conf.ini
+var SMSRetryLimit = 3
+
+// RetryDelay пауза перед первой повторной попыткой, каждая следующая вдвое дольше,
+// но не больше RetryMaxDelay
+var RetryDelay = 30 * time.Second
+var RetryMaxDelay = time.Hour
+
+// SendTimeout сколько может длиться одна отправка со всеми частями, после этого
+// модем прекращает ее и результат неизвестен
+var SendTimeout = 5 * time.Minute
+
+// LeaseTimeout на сколько загрузчик забирает сообщение из базы, перед отправкой аренда
+// продлевается еще на SendTimeout. Сообщения экземпляра, который упал, не дождавшись
+// ответа модема, отправляются заново только после ее окончания
+var LeaseTimeout = 10 * time.Minute
+
+// InstanceID имя экземпляра шлюза в locked_by, по умолчанию имя хоста и pid
+var InstanceID string
+
+var leaseCount uint64
+
+// newLease метка одной аренды: экземпляр и порядковый номер
+func newLease() string {
+	return fmt.Sprintf("%s/%d", InstanceID, atomic.AddUint64(&leaseCount, 1))
+}
+
+// retryDelay экспоненциальная пауза после retries неудачных попыток со случайной
+// добавкой до половины паузы, чтобы повторы многих сообщений не шли одной волной
+func retryDelay(retries int) time.Duration {
+	delay := RetryDelay
+	for i := 1; i < retries && delay < RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > RetryMaxDelay {
+		delay = RetryMaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
 
 const (
-	SMSPending   = iota // 0
-	SMSProcessed        // 1
-	SMSError            // 2
+	SMSPending    = iota // 0
+	SMSProcessed         // 1
+	SMSError             // 2
+	SMSDelivered         // 3, подтверждено отчетом о доставке
+	SMSExpired           // 4, в SMSC истек срок жизни
+	SMSRejected          // 5, SMSC отказался доставлять
+	SMSCancelled         // 6, отменено через API до отправки
+	SMSDeadLetter        // 7, попытки и каналы исчерпаны, ждет ручного повтора
+	SMSUnknown           // 8, модем не ответил после PDU, сообщение могло уйти; не повторяется само
+	smsStatusCount
 )
 
+// приоритеты, меньшее значение отправляется первым
+const (
+	PriorityOTP           = iota // 0, одноразовые пароли
+	PriorityTransactional        // 1, по умолчанию
+	PriorityBulk                 // 2, рассылки и пакеты
+	priorityCount
+)
+
+// priorityNames имена приоритетов в API
+var priorityNames = []string{"otp", "transactional", "bulk"}
+
+// starvationLimit после стольких более срочных сообщений ждущее менее срочное отправляется вне очереди
+const starvationLimit = 10
+
+// ParsePriority приоритет по имени, пустое имя - transactional
+func ParsePriority(name string) (int, error) {
+	if name == "" {
+		return PriorityTransactional, nil
+	}
+	for priority, priorityName := range priorityNames {
+		if name == priorityName {
+			return priority, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q, expected otp, transactional or bulk", name)
+}
+
 type SMS struct {
 	UUID      string `json:"uuid"`
 	Body      string `json:"body"`
@@ -24,7 +105,32 @@ type SMS struct {
 	Device    string `json:"device"`
 	CreatedAt string `json:"created_at"`
 	UpdatedAt string `json:"updated_at"`
-	User      *User  `json:"user"`
+	// DeliveredAt время из отчета о доставке
+	DeliveredAt string `json:"delivered_at"`
+	// Route политика доставки, Channel текущий канал из нее
+	Route   string `json:"route"`
+	Channel string `json:"channel"`
+	// FallbackAt когда перейти к следующему каналу, если сообщение так и не доставлено
+	FallbackAt string `json:"fallback_at"`
+	// ProviderID идентификатор у провайдера канала, Error текст последней ошибки
+	ProviderID string `json:"provider_id"`
+	Error      string `json:"error"`
+	// ErrorCode код +CMS/+CME ERROR последней ошибки модема, 0 если его не было
+	ErrorCode int `json:"error_code"`
+	// ParentUUID попытка в предыдущем канале, после которой создана эта
+	ParentUUID string `json:"parent_uuid"`
+	// BatchID пакет массовой рассылки, к которому относится сообщение
+	BatchID string `json:"batch_id"`
+	// SendAt не отправлять раньше этого времени (UTC), Marketing учитывать тихие часы
+	SendAt    string `json:"send_at"`
+	Marketing bool   `json:"marketing"`
+	// Priority очередность отправки, PriorityOTP первым
+	Priority int `json:"priority"`
+	// NextAttemptAt не повторять отправку раньше этого времени (UTC)
+	NextAttemptAt string `json:"next_attempt_at"`
+	User          *User  `json:"user"`
+	// lease метка аренды, под которой сообщение загружено в очередь
+	lease string
 }
 
 // User структура пользователя с данными для отправки сообщений
@@ -32,9 +138,24 @@ type User struct {
 	ID             int64  `json:"id"`
 	PhoneNumber    string `json:"phone_number"`
 	ChatIdTelegram string `json:"chat_id_telegram"`
+	// Route политика доставки по умолчанию для номера
+	Route string `json:"route"`
+	// Timezone часовой пояс IANA для тихих часов, пусто - DefaultTimezone
+	Timezone string `json:"timezone"`
+}
+
+// InboundSMS входящее сообщение, полученное модемом
+type InboundSMS struct {
+	ID        int64  `json:"id"`
+	Sender    string `json:"sender"`
+	Body      string `json:"body"`
+	Device    string `json:"device"`
+	SentAt    string `json:"sent_at"`
+	CreatedAt string `json:"created_at"`
 }
 
-var messages chan SMS
+// queues очереди всех каналов
+var queues map[string]*priorityQueue
 var wakeupMessageLoader chan bool
 
 var bufferMaxSize int
@@ -44,8 +165,19 @@ var timeOfLastWakeup time.Time
 var messageLoaderTimeout time.Duration
 var messageLoaderCountout int
 var messageLoaderLongTimeout time.Duration
+var receiveInterval time.Duration
 
-func InitWorker(modems []*modem.GSMModem, bufferSize, bufferLow, loaderTimeout, countOut, loaderLongTimeout int) {
+// stopping закрывается StopWorker: устройства больше не берут сообщения, загрузчик не читает базу
+var stopping chan struct{}
+
+// sendContext родитель отправок, отменяется, только если они не закончились за время остановки
+var sendContext = context.Background()
+var abortSends context.CancelFunc
+
+// workers горутины processMessages и загрузчиков, которых ждет StopWorker
+var workers sync.WaitGroup
+
+func InitWorker(transports map[string][]transport.Transport, bufferSize, bufferLow, loaderTimeout, countOut, loaderLongTimeout, receiveTimeout int) {
 	log.Println("--- InitWorker")
 
 	bufferMaxSize = bufferSize
@@ -53,8 +185,22 @@ func InitWorker(modems []*modem.GSMModem, bufferSize, bufferLow, loaderTimeout,
 	messageLoaderTimeout = time.Duration(loaderTimeout) * time.Minute
 	messageLoaderCountout = countOut
 	messageLoaderLongTimeout = time.Duration(loaderLongTimeout) * time.Minute
+	receiveInterval = time.Duration(receiveTimeout) * time.Second
+	if receiveInterval <= 0 {
+		receiveInterval = time.Minute
+	}
 
-	messages = make(chan SMS, bufferMaxSize)
+	if InstanceID == "" {
+		host, _ := os.Hostname()
+		InstanceID = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	stopping = make(chan struct{})
+	sendContext, abortSends = context.WithCancel(context.Background())
+
+	queues = make(map[string]*priorityQueue)
+	for channel := range transports {
+		queues[channel] = newPriorityQueue(bufferMaxSize)
+	}
 	wakeupMessageLoader = make(chan bool, 1)
 	wakeupMessageLoader <- true
 	messageCountSinceLastWakeup = 0
@@ -63,16 +209,75 @@ func InitWorker(modems []*modem.GSMModem, bufferSize, bufferLow, loaderTimeout,
 	// its important to init messages channel before starting modems because nil
 	// channel is non-blocking
 
-	for i := 0; i < len(modems); i++ {
-		modem := modems[i]
-		err := modem.Connect()
-		if err != nil {
-			log.Println("InitWorker: error connecting", modem.DeviceId, err)
-			continue
+	for channel, channelTransports := range transports {
+		for i := 0; i < len(channelTransports); i++ {
+			t := channelTransports[i]
+			if connector, ok := t.(interface{ Connect() error }); ok {
+				// устройство, которого еще нет, супервизор продолжит переподключать
+				if err := connector.Connect(); err != nil {
+					log.Println("InitWorker: error connecting", t.ID(), err)
+				}
+			}
+			workers.Add(1)
+			go processMessages(t, channel)
 		}
-		go processMessages(modem)
 	}
+	workers.Add(2)
 	go messageLoader(bufferMaxSize, bufferLowCount)
+	go fallbackLoop()
+}
+
+// StopWorker останавливает отправку: каждое устройство заканчивает текущее сообщение и больше
+// ничего не берет, после чего порты модемов закрываются. Если ctx истекает раньше, незаконченные
+// отправки прерываются, их результат сохраняется как неизвестный. С сообщений, оставшихся в
+// очередях, снимается аренда, в базе они по-прежнему ждут отправки
+func StopWorker(ctx context.Context) error {
+	log.Println("--- StopWorker")
+	close(stopping)
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		log.Println("StopWorker: ", "devices are still busy, aborting")
+		abortSends()
+		// проверка, USSD запрос или переподключение в работе прерываются закрытием порта
+		closeTransports()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			log.Println("StopWorker: ", "devices did not stop")
+		}
+	}
+	closeTransports()
+
+	// иначе их не отправит ни этот, ни другой экземпляр, пока не пройдет LeaseTimeout
+	for _, queue := range queues {
+		for _, message := range queue.drain() {
+			releaseLease(message)
+		}
+	}
+	return err
+}
+
+// closeTransports закрывает порты модемов и другие транспорты, которые это умеют
+func closeTransports() {
+	supervisorsMu.Lock()
+	defer supervisorsMu.Unlock()
+	for _, s := range supervisors {
+		if closer, ok := s.transport.(interface{ Close() error }); ok {
+			if err := closer.Close(); err != nil {
+				log.Println("closeTransports: ", s.transport.ID(), err)
+			}
+		}
+	}
 }
 
 func EnqueueMessage(message *SMS, insertToDB bool) {
@@ -95,7 +300,16 @@ func EnqueueMessage(message *SMS, insertToDB bool) {
 	}()
 }
 
+// wakeupLoader не блокируется, если загрузчик уже разбужен
+func wakeupLoader() {
+	select {
+	case wakeupMessageLoader <- true:
+	default:
+	}
+}
+
 func messageLoader(bufferSize, minFill int) {
+	defer workers.Done()
 	// Load pending messages from database as needed
 	for {
 
@@ -106,9 +320,14 @@ func messageLoader(bufferSize, minFill int) {
 		   stalled in the system until someone knocks on the API door
 		   - we can afford a really long polling in this case
 		*/
+		// отложенные сообщения и повторы не должны ждать длинного тайм-аута
+		sleep := messageLoaderLongTimeout
+		if sendAt, ok := getNextSendAt(); ok && time.Until(sendAt) < sleep {
+			sleep = time.Until(sendAt) + time.Second
+		}
 		timeout := make(chan bool, 1)
 		go func() {
-			time.Sleep(messageLoaderLongTimeout)
+			time.Sleep(sleep)
 			timeout <- true
 		}()
 		log.Println("messageLoader: ", "waiting for wakeup call")
@@ -117,55 +336,460 @@ func messageLoader(bufferSize, minFill int) {
 			log.Println("messageLoader: woken up by channel call")
 		case <-timeout:
 			log.Println("messageLoader: woken up by timeout")
+		case <-stopping:
+			log.Println("messageLoader: stopped")
+			return
 		}
-		if len(messages) >= bufferLowCount {
+		if queuedCount() >= bufferLowCount {
 			//if we have sufficient number of messages to process,
 			//don't bother hitting the database
 			log.Println("messageLoader: ", "I have sufficient messages")
 			continue
 		}
 
-		countToFetch := bufferMaxSize - len(messages)
+		countToFetch := bufferMaxSize - queuedCount()
 		log.Println("messageLoader: ", "I need to fetch more messages", countToFetch)
 		pendingMsgs, err := getPendingMessages(countToFetch)
 		if err == nil {
 			log.Println("messageLoader: ", len(pendingMsgs), " pending messages found")
 			for _, msg := range pendingMsgs {
-				messages <- msg
+				queue, ok := queues[msg.Channel]
+				if !ok {
+					log.Println("messageLoader: no transport for channel", msg.Channel, msg.UUID)
+					msg.Status = SMSError
+					msg.Retries = SMSRetryLimit
+					msg.Error = "no transport for channel " + msg.Channel
+					if !advanceRoute(msg) {
+						msg.Status = SMSDeadLetter
+					}
+					updateMessageStatus(msg)
+					continue
+				}
+				queue.push(msg)
+			}
+		}
+	}
+}
+
+// queuedCount сообщений во всех очередях
+func queuedCount() int {
+	count := 0
+	for _, queue := range queues {
+		count += queue.len()
+	}
+	return count
+}
+
+// priorityQueue очередь канала: сначала более высокий приоритет, но сообщение,
+// пропустившее starvationLimit более срочных, отправляется вне очереди
+type priorityQueue struct {
+	mu      sync.Mutex
+	levels  [priorityCount][]SMS
+	skipped [priorityCount]int
+	// ready по одному значению на каждое сообщение в очереди
+	ready chan bool
+}
+
+func newPriorityQueue(size int) *priorityQueue {
+	return &priorityQueue{ready: make(chan bool, size)}
+}
+
+// push блокируется, пока очередь полна, как буферизованный канал, и до остановки worker
+func (q *priorityQueue) push(message SMS) {
+	priority := message.Priority
+	if priority < 0 || priority >= priorityCount {
+		priority = PriorityTransactional
+	}
+	q.mu.Lock()
+	q.levels[priority] = append(q.levels[priority], message)
+	q.mu.Unlock()
+	select {
+	case q.ready <- true:
+	case <-stopping:
+		// его больше никто не возьмет, в базе оно по-прежнему ждет отправки
+	}
+}
+
+// pop вызывается ровно один раз на каждое значение, полученное из ready
+func (q *priorityQueue) pop() SMS {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	level := -1
+	for priority := priorityCount - 1; priority >= 0; priority-- {
+		if len(q.levels[priority]) > 0 && q.skipped[priority] >= starvationLimit {
+			level = priority
+			break
+		}
+	}
+	if level < 0 {
+		for priority := 0; priority < priorityCount; priority++ {
+			if len(q.levels[priority]) > 0 {
+				level = priority
+				break
 			}
 		}
 	}
+
+	for priority := level + 1; priority < priorityCount; priority++ {
+		if len(q.levels[priority]) > 0 {
+			q.skipped[priority]++
+		}
+	}
+	q.skipped[level] = 0
+	message := q.levels[level][0]
+	q.levels[level] = q.levels[level][1:]
+	return message
+}
+
+func (q *priorityQueue) len() int {
+	return len(q.ready)
 }
 
-func processMessages(gsmModem *modem.GSMModem) {
+// drain забирает все сообщения, когда очередь больше никто не читает
+func (q *priorityQueue) drain() []SMS {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var messages []SMS
+	for priority := range q.levels {
+		messages = append(messages, q.levels[priority]...)
+		q.levels[priority] = nil
+	}
+	return messages
+}
+
+// fallbackLoop переводит на следующий канал сообщения, не доставленные за отведенное время
+func fallbackLoop() {
+	defer workers.Done()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopping:
+			return
+		}
+		due, err := getDueFallbacks()
+		if err != nil {
+			continue
+		}
+		for _, msg := range due {
+			log.Println("fallbackLoop: ", msg.UUID, "was not delivered via", msg.Channel)
+			advanceRoute(msg)
+		}
+	}
+}
+
+// advanceRoute создает попытку в следующем канале политики, false если каналов больше нет.
+// Текущая попытка остается в базе со своим статусом и ошибкой.
+func advanceRoute(message SMS) bool {
+	route, err := ParseRoute(message.Route)
+	if err != nil {
+		log.Println("advanceRoute: ", message.UUID, err)
+		return false
+	}
+	next := route.next(message.Channel)
+	if next == "" {
+		return false
+	}
+
+	if message.Status == SMSProcessed {
+		// отправлено, но не доставлено вовремя; второй раз к следующему каналу не переходим
+		if err := clearFallback(message.UUID); err != nil {
+			return false
+		}
+	}
+
+	id, err := uuid.NewV1()
+	if err != nil {
+		log.Println("advanceRoute: ", message.UUID, err)
+		return false
+	}
+	log.Println("advanceRoute: ", message.UUID, message.Channel, "->", next, id.String())
+	attempt := &SMS{
+		UUID:       id.String(),
+		Body:       message.Body,
+		User:       message.User,
+		Route:      message.Route,
+		Channel:    next,
+		ParentUUID: message.UUID,
+		BatchID:    message.BatchID,
+		Marketing:  message.Marketing,
+		Priority:   message.Priority,
+	}
+	EnqueueMessage(attempt, true)
+	return true
+}
+
+func processMessages(t transport.Transport, channel string) {
+	defer workers.Done()
 	defer func() {
 		log.Println("--- deferring ProcessMessage")
 	}()
 
 	//log.Println("--- ProcessMessage")
+	// принимают сообщения только модемы, для других транспортов эти каналы nil.
+	// модем сам выполняет одну транзакцию за раз, входящие читает эта же горутина,
+	// поэтому неисправный или ограниченный лимитом модем обрабатывается в одном месте
+	var incoming <-chan bool
+	var receiveTick, probeTick <-chan time.Time
+	sup := supervise(t, channel)
+	gsmModem, isModem := t.(*modem.GSMModem)
+	if isModem {
+		receiveTicker := time.NewTicker(receiveInterval)
+		defer receiveTicker.Stop()
+		probeTicker := time.NewTicker(ProbeInterval)
+		defer probeTicker.Stop()
+		incoming = gsmModem.Incoming()
+		receiveTick = receiveTicker.C
+		probeTick = probeTicker.C
+		if sup.healthy() {
+			sup.probe()
+		}
+	}
 	for {
-		message := <-messages
-		log.Println("processing: ", message.UUID, gsmModem.DeviceId)
-
-		status := gsmModem.SendSMS(message.User.PhoneNumber, message.Body)
-		log.Println(status, "Status !!")
-		if strings.Contains(status, modem.SMSStatusOk) {
-			message.Status = SMSProcessed
-		} else if strings.Contains(status, modem.SMSStatusError) {
-			message.Status = SMSError
-		} else {
-			message.Status = SMSPending
-		}
-		message.Device = gsmModem.DeviceId
-		message.Retries++
-		updateMessageStatus(message)
-		if message.Status != SMSProcessed && message.Retries < SMSRetryLimit {
-			// push message back to queue until either it is sent successfully or
-			// retry count is reached
-			// I can't push it to channel directly. Doing so may cause the sms to be in
-			// the queue twice. I don't want that
-			EnqueueMessage(&message, false)
+		// worker останавливается, текущая отправка завершена
+		select {
+		case <-stopping:
+			return
+		default:
+		}
+		// устройство сверх лимита оставляет очередь другим, пока лимит снова не позволит
+		ready := queues[channel].ready
+		var limitPassed, reconnect, balanceDue <-chan time.Time
+		healthy := sup.healthy()
+		if wait, ok := sup.untilBalance(); ok && healthy {
+			balanceDue = time.After(wait)
+		}
+		if !healthy {
+			// неисправный модем ничего не берет, пока его не переподключат
+			ready = nil
+			reconnect = time.After(sup.untilReconnect())
+		} else if wait := rateLimitWait(t.ID(), 1); wait > 0 {
+			log.Println("processMessages: ", t.ID(), "rate limited for", wait)
+			ready = nil
+			limitPassed = time.After(wait)
+		}
+		select {
+		case <-stopping:
+			return
+		case <-ready:
+			select {
+			case <-stopping:
+				// готовы оба, сообщение остается ждать в базе
+				return
+			default:
+			}
+			sendMessage(t, queues[channel].pop())
+		case <-limitPassed:
+		case <-reconnect:
+			sup.reconnect()
+		case <-probeTick:
+			if healthy {
+				sup.probe()
+			}
+		case <-balanceDue:
+			sup.checkBalance()
+		case <-incoming:
+			if healthy {
+				receiveMessages(gsmModem)
+			}
+		case <-receiveTick:
+			if healthy {
+				receiveMessages(gsmModem)
+			}
 		}
 		time.Sleep(5 * time.Microsecond)
 	}
 }
+
+func sendMessage(t transport.Transport, message SMS) {
+	log.Println("processing: ", message.UUID, message.Channel, t.ID())
+
+	// аренда могла истечь, пока сообщение ждало в очереди, и его забрал другой загрузчик,
+	// возможно другого экземпляра, или сообщение отменили. Дальше оно наше до конца отправки,
+	// отменить или изменить его нельзя
+	if !renewLease(message, SendTimeout+LeaseTimeout) {
+		log.Println("processing: ", message.UUID, "cancelled or claimed by someone else, skipping")
+		return
+	}
+
+	// сообщение могли изменить, пока оно ждало в очереди
+	current, err := GetMessage(message.UUID)
+	if err == nil && current != nil {
+		message.Body = current.Body
+		message.User = current.User
+		message.Marketing = current.Marketing
+	}
+
+	if message.Marketing {
+		if until, quiet := quietUntil(message.User, time.Now()); quiet {
+			// отложить, а не ошибка: загрузчик снова возьмет его после тихих часов
+			log.Println("processing: ", message.UUID, "quiet hours for recipient, deferred until", until)
+			deferMessage(message.UUID, until)
+			return
+		}
+	}
+
+	// одна часть еще помещается в лимит, но многочастное сообщение может его превысить
+	parts := messageParts(t, message.Body)
+	if wait := rateLimitWait(t.ID(), parts); wait > 0 {
+		log.Println("processing: ", message.UUID, parts, "parts exceed the rate limit of", t.ID(), "deferred for", wait)
+		deferMessage(message.UUID, time.Now().Add(wait))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(sendContext, SendTimeout)
+	result, err := t.Send(ctx, transport.Message{
+		UUID: message.UUID,
+		To:   message.User.PhoneNumber,
+		Body: message.Body,
+	})
+	cancel()
+	log.Println("processing: ", message.UUID, len(result.Parts), "parts, status", result.Status, err)
+	recordDeviceUsage(t.ID(), sentParts(result))
+	switch result.Status {
+	case transport.StatusSent:
+		message.Status = SMSProcessed
+		if message.Channel == ChannelTelegram {
+			// Bot API принимает сообщение только в существующий чат, отчета позже не будет
+			message.Status = SMSDelivered
+		}
+	case transport.StatusFailed:
+		message.Status = SMSError
+	default:
+		// повтор может доставить сообщение дважды. Части с TP-MR ждут отчета о доставке,
+		// остальное решает оператор через RetryMessage
+		message.Status = SMSUnknown
+	}
+	message.Device = t.ID()
+	message.Retries++
+	message.ProviderID = result.ProviderID
+	message.Error = ""
+	message.ErrorCode = 0
+	if err != nil {
+		message.Error = err.Error()
+		message.ErrorCode = modemErrorCode(err)
+	}
+	if transport.IsPermanent(err) {
+		// повтор не поможет: неверный номер, запрет или пользователь не привязал этот канал
+		log.Println("processing: ", message.UUID, "permanent failure, not retrying")
+		message.Retries = SMSRetryLimit
+	}
+	message.NextAttemptAt = ""
+	retry := message.Status == SMSError && message.Retries < SMSRetryLimit
+	if retry {
+		message.NextAttemptAt = time.Now().UTC().Add(retryDelay(message.Retries)).Format(timeFormat)
+	}
+	message.FallbackAt = ""
+	if message.Status == SMSProcessed {
+		if route, err := ParseRoute(message.Route); err == nil && route.wait(message.Channel) > 0 {
+			message.FallbackAt = time.Now().UTC().Add(route.wait(message.Channel)).Format(timeFormat)
+		}
+	}
+	updateMessageStatus(message)
+	// аренда снята вместе с сохранением результата
+	message.lease = ""
+	if message.Status == SMSProcessed || message.Status == SMSUnknown {
+		replaceMessageParts(message.UUID, message.Device, result.Parts)
+	}
+	if retry {
+		// загрузчик возьмет его снова в next_attempt_at, он должен узнать об этом сейчас,
+		// чтобы не проспать
+		log.Println("processing: ", message.UUID, "retry at", message.NextAttemptAt)
+		wakeupLoader()
+	} else if message.Status == SMSUnknown {
+		log.Println("processing: ", message.UUID, "outcome unknown, not retrying:", message.Error)
+	} else if message.Status != SMSProcessed && message.Status != SMSDelivered {
+		// получатель без этого канала - не ошибка доставки, повторять вручную нечего
+		if !advanceRoute(message) && err != transport.ErrNoRecipient {
+			log.Println("processing: ", message.UUID, "dead letter:", message.Error)
+			message.Status = SMSDeadLetter
+			updateMessageStatus(message)
+		}
+	}
+}
+
+// modemErrorCode код ошибки модема из ошибки транспорта
+func modemErrorCode(err error) int {
+	if permanent, ok := err.(*transport.PermanentError); ok {
+		err = permanent.Err
+	}
+	switch err := err.(type) {
+	case *modem.CMSError:
+		return err.Code
+	case *modem.CMEError:
+		return err.Code
+	}
+	return 0
+}
+
+// RetryMessage возвращает в очередь сообщение из dead letter или с неизвестным исходом
+// отправки с обнуленными попытками, false если сообщения нет или оно не ждет ручного повтора
+func RetryMessage(uuid string) (bool, error) {
+	requeued, err := requeueDeadLetter(uuid)
+	if err != nil || !requeued {
+		return requeued, err
+	}
+	message, err := GetMessage(uuid)
+	if err != nil || message == nil {
+		return false, err
+	}
+	EnqueueMessage(message, false)
+	return true, nil
+}
+
+// receiveMessages сохраняет входящие сообщения и отчеты о доставке из памяти модема и удаляет их оттуда
+func receiveMessages(gsmModem *modem.GSMModem) {
+	inbound, reports, err := gsmModem.ReadMessages()
+	if err != nil {
+		log.Println("receiveMessages: ", gsmModem.DeviceId, err)
+		return
+	}
+
+	for _, msg := range inbound {
+		sms := &InboundSMS{
+			Sender: msg.Sender,
+			Body:   msg.Body,
+			Device: gsmModem.DeviceId,
+			SentAt: msg.Timestamp.UTC().Format(timeFormat),
+		}
+		if err := insertInboundMessage(sms); err != nil {
+			// оставляем в памяти модема, прочитаем в следующий раз
+			continue
+		}
+		for _, index := range msg.Indexes {
+			if err := gsmModem.DeleteMessage(index); err != nil {
+				log.Println("receiveMessages: ", gsmModem.DeviceId, "delete", index, err)
+			}
+		}
+	}
+
+	for _, report := range reports {
+		if err := applyStatusReport(gsmModem.DeviceId, report); err != nil {
+			continue
+		}
+		if report.Index >= 0 {
+			if err := gsmModem.DeleteMessage(report.Index); err != nil {
+				log.Println("receiveMessages: ", gsmModem.DeviceId, "delete report", report.Index, err)
+			}
+		}
+	}
+}
+
+// applyStatusReport отмечает часть сообщения по отчету о доставке и пересчитывает статус сообщения
+func applyStatusReport(device string, report *modem.StatusReport) error {
+	log.Println("applyStatusReport: ", device, report.Reference, report.Recipient, report.Status)
+	if !report.Final() {
+		// SMSC еще пытается доставить, ждем следующего отчета
+		return nil
+	}
+
+	status := SMSRejected
+	if report.Delivered() {
+		status = SMSDelivered
+	} else if report.Expired() {
+		status = SMSExpired
+	}
+	return updateMessagePartStatus(device, report.Reference, status, report.Timestamp.UTC().Format(timeFormat))
+}
@@ -0,0 +1,697 @@
+package gosms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gosms/transport"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport канал для тестов: отвечает тем, что вернет send, и запоминает отправленное
+type fakeTransport struct {
+	id   string
+	send func(msg transport.Message) (transport.Result, error)
+
+	mu   sync.Mutex
+	sent []transport.Message
+}
+
+func (f *fakeTransport) ID() string { return f.id }
+
+func (f *fakeTransport) Health() transport.Health { return transport.Health{Healthy: true} }
+
+func (f *fakeTransport) Send(ctx context.Context, msg transport.Message) (transport.Result, error) {
+	f.mu.Lock()
+	f.sent = append(f.sent, msg)
+	f.mu.Unlock()
+	if f.send == nil {
+		return transport.Result{Status: transport.StatusSent, Parts: []transport.Part{{Part: 1, Status: transport.StatusSent, Reference: 1}}}, nil
+	}
+	return f.send(msg)
+}
+
+func (f *fakeTransport) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.sent)
+}
+
+func failWith(err error) func(transport.Message) (transport.Result, error) {
+	return func(transport.Message) (transport.Result, error) {
+		return transport.Result{Status: transport.StatusFailed}, err
+	}
+}
+
+// setupWorker новая база и состояние worker без горутин: сообщения отправляет dispatch
+func setupWorker(t *testing.T) *User {
+	t.Helper()
+	if _, err := InitDB("sqlite3", filepath.Join(t.TempDir(), "db.sqlite")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	wakeupMessageLoader = make(chan bool, 100)
+	// повторы без паузы, паузы проверяет TestRetryDelay
+	retryDelay := RetryDelay
+	RetryDelay = 0
+	t.Cleanup(func() { RetryDelay = retryDelay })
+
+	user, err := InsertUser(&User{PhoneNumber: "+79001234567"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func enqueueTest(t *testing.T, user *User, uuid, route string) {
+	t.Helper()
+	parsed, err := ParseRoute(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sms := &SMS{UUID: uuid, Body: "code 1234", User: user, Route: route, Channel: parsed.Steps[0].Channel}
+	if err := insertMessage(sms); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dispatch загружает ждущие сообщения, как messageLoader, и отправляет каждое через канал,
+// как processMessages
+func dispatch(t *testing.T, transports map[string]transport.Transport) int {
+	t.Helper()
+	messages, err := getPendingMessages(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range messages {
+		sendMessage(transports[message.Channel], message)
+	}
+	return len(messages)
+}
+
+func mustGet(t *testing.T, uuid string) SMS {
+	t.Helper()
+	sms, err := GetMessage(uuid)
+	if err != nil || sms == nil {
+		t.Fatalf("GetMessage(%s) = %v, %v", uuid, sms, err)
+	}
+	return *sms
+}
+
+func TestWorkerSend(t *testing.T) {
+	user := setupWorker(t)
+	sms := &fakeTransport{id: "sim0"}
+	transports := map[string]transport.Transport{ChannelSMS: sms}
+	enqueueTest(t, user, "m1", "sms")
+
+	if n := dispatch(t, transports); n != 1 {
+		t.Fatalf("dispatched %d messages, want 1", n)
+	}
+	got := mustGet(t, "m1")
+	if got.Status != SMSProcessed || got.Device != "sim0" || got.Retries != 1 {
+		t.Errorf("after send %+v", got)
+	}
+	if sms.count() != 1 || sms.sent[0].UUID != "m1" || sms.sent[0].To != user.PhoneNumber || sms.sent[0].Body != "code 1234" {
+		t.Errorf("transport got %+v", sms.sent)
+	}
+	if n := dispatch(t, transports); n != 0 {
+		t.Errorf("a sent message was loaded again")
+	}
+}
+
+func TestWorkerSendFailure(t *testing.T) {
+	user := setupWorker(t)
+	sms := &fakeTransport{id: "sim0", send: failWith(errors.New("no network"))}
+	transports := map[string]transport.Transport{ChannelSMS: sms}
+	enqueueTest(t, user, "m1", "sms")
+
+	for attempt := 1; attempt <= SMSRetryLimit; attempt++ {
+		if n := dispatch(t, transports); n != 1 {
+			t.Fatalf("attempt %d: dispatched %d", attempt, n)
+		}
+		// после последней попытки сообщение уходит в dead letter
+		want := SMSError
+		if attempt == SMSRetryLimit {
+			want = SMSDeadLetter
+		}
+		if got := mustGet(t, "m1"); got.Status != want || got.Retries != attempt {
+			t.Fatalf("attempt %d: %+v", attempt, got)
+		}
+	}
+	if n := dispatch(t, transports); n != 0 {
+		t.Errorf("sent again after %d attempts", SMSRetryLimit)
+	}
+}
+
+func TestWorkerRetryBackoff(t *testing.T) {
+	user := setupWorker(t)
+	RetryDelay = time.Minute
+	sms := &fakeTransport{id: "sim0", send: failWith(errors.New("no network"))}
+	transports := map[string]transport.Transport{ChannelSMS: sms}
+	enqueueTest(t, user, "m1", "sms")
+
+	dispatch(t, transports)
+	got := mustGet(t, "m1")
+	next, err := time.Parse(timeFormat, got.NextAttemptAt)
+	if err != nil || got.Status != SMSError || time.Until(next) < 50*time.Second {
+		t.Fatalf("after failure %+v", got)
+	}
+	if n := dispatch(t, transports); n != 0 {
+		t.Errorf("retried before next_attempt_at")
+	}
+}
+
+func TestWorkerPermanentFailure(t *testing.T) {
+	user := setupWorker(t)
+	sms := &fakeTransport{id: "sim0", send: failWith(transport.Permanent(errors.New("+CMS ERROR: 21")))}
+	transports := map[string]transport.Transport{ChannelSMS: sms}
+	enqueueTest(t, user, "m1", "sms")
+
+	dispatch(t, transports)
+	if got := mustGet(t, "m1"); got.Status != SMSDeadLetter || got.Retries != SMSRetryLimit || got.NextAttemptAt != "" {
+		t.Errorf("after permanent failure %+v", got)
+	}
+	if n := dispatch(t, transports); n != 0 || sms.count() != 1 {
+		t.Errorf("a permanent failure was retried")
+	}
+}
+
+func TestWorkerRetryDeadLetter(t *testing.T) {
+	user := setupWorker(t)
+	sms := &fakeTransport{id: "sim0", send: failWith(transport.Permanent(errors.New("+CMS ERROR: 21")))}
+	transports := map[string]transport.Transport{ChannelSMS: sms}
+	enqueueTest(t, user, "m1", "sms")
+	enqueueTest(t, user, "m2", "sms")
+	dispatch(t, transports)
+
+	if ok, err := RetryMessage("m1"); !ok || err != nil {
+		t.Fatalf("RetryMessage = %v, %v", ok, err)
+	}
+	if got := mustGet(t, "m1"); got.Status != SMSPending || got.Retries != 0 {
+		t.Errorf("after retry %+v", got)
+	}
+	sms.send = nil
+	if n := dispatch(t, transports); n != 1 {
+		t.Errorf("dispatched %d, want only the retried message", n)
+	}
+	if got := mustGet(t, "m1"); got.Status != SMSProcessed {
+		t.Errorf("after resend %+v", got)
+	}
+	// повторить можно только dead letter
+	for _, uuid := range []string{"m1", "missing"} {
+		if ok, _ := RetryMessage(uuid); ok {
+			t.Errorf("RetryMessage(%s) accepted", uuid)
+		}
+	}
+}
+
+// sendUnknown ответ модема, который не подтвердил последнюю часть после передачи PDU
+func sendUnknown(parts ...transport.Part) func(transport.Message) (transport.Result, error) {
+	return func(transport.Message) (transport.Result, error) {
+		return transport.Result{Status: transport.StatusUnknown, Parts: parts}, context.DeadlineExceeded
+	}
+}
+
+func TestWorkerUnknownNotRetried(t *testing.T) {
+	user := setupWorker(t)
+	sms := &fakeTransport{id: "sim0", send: sendUnknown(
+		transport.Part{Part: 1, Status: transport.StatusSent, Reference: 5},
+		transport.Part{Part: 2, Status: transport.StatusUnknown, Reference: -1})}
+	telegram := &fakeTransport{id: "telegram"}
+	transports := map[string]transport.Transport{ChannelSMS: sms, ChannelTelegram: telegram}
+	enqueueTest(t, user, "m1", "sms,telegram")
+	dispatch(t, transports)
+
+	got := mustGet(t, "m1")
+	if got.Status != SMSUnknown || got.NextAttemptAt != "" || got.Error == "" {
+		t.Fatalf("after unknown outcome %+v", got)
+	}
+	// сообщение могло уйти: ни повтора, ни следующего канала маршрута
+	if n := dispatch(t, transports); n != 0 {
+		t.Errorf("dispatched %d, want 0", n)
+	}
+	if attempts, _ := GetMessages("WHERE parent_uuid = 'm1'"); len(attempts) != 0 {
+		t.Errorf("route advanced: %+v", attempts)
+	}
+	if telegram.count() != 0 || sms.count() != 1 {
+		t.Errorf("sent via sms %d, telegram %d; want 1, 0", sms.count(), telegram.count())
+	}
+
+	// отчет о первой части не делает сообщение доставленным: о второй ничего не известно
+	if err := updateMessagePartStatus("sim0", 5, SMSDelivered, "2026-03-10 12:00:00"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustGet(t, "m1"); got.Status != SMSUnknown {
+		t.Errorf("after partial report %+v", got)
+	}
+
+	// оператор решает отправить заново
+	if ok, err := RetryMessage("m1"); !ok || err != nil {
+		t.Fatalf("RetryMessage = %v, %v", ok, err)
+	}
+	sms.send = nil
+	if n := dispatch(t, transports); n != 1 {
+		t.Errorf("dispatched %d after retry, want 1", n)
+	}
+	if got := mustGet(t, "m1"); got.Status != SMSProcessed {
+		t.Errorf("after resend %+v", got)
+	}
+}
+
+func TestWorkerUnknownResolvedByReport(t *testing.T) {
+	user := setupWorker(t)
+	sms := &fakeTransport{id: "sim0", send: sendUnknown(transport.Part{Part: 1, Status: transport.StatusSent, Reference: 7})}
+	transports := map[string]transport.Transport{ChannelSMS: sms}
+	enqueueTest(t, user, "m1", "sms")
+	enqueueTest(t, user, "m2", "sms")
+	dispatch(t, transports)
+
+	if err := updateMessagePartStatus("sim0", 7, SMSRejected, "2026-03-10 12:00:00"); err != nil {
+		t.Fatal(err)
+	}
+	// оба сообщения получили TP-MR 7, отчет относится к последнему
+	if got := mustGet(t, "m2"); got.Status != SMSRejected {
+		t.Errorf("after rejected report %+v", got)
+	}
+	if err := updateMessagePartStatus("sim0", 7, SMSDelivered, "2026-03-10 12:00:00"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustGet(t, "m1"); got.Status != SMSDelivered || got.DeliveredAt == "" {
+		t.Errorf("after delivery report %+v", got)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		retries int
+		min     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{20, time.Hour},
+	}
+	for _, tt := range tests {
+		// случайная добавка не больше половины паузы
+		if got := retryDelay(tt.retries); got < tt.min || got > tt.min*3/2 {
+			t.Errorf("retryDelay(%d) = %v, want %v..%v", tt.retries, got, tt.min, tt.min*3/2)
+		}
+	}
+}
+
+func TestWorkerRoute(t *testing.T) {
+	user := setupWorker(t)
+	telegram := &fakeTransport{id: "telegram", send: failWith(transport.ErrNoRecipient)}
+	sms := &fakeTransport{id: "sim0"}
+	transports := map[string]transport.Transport{ChannelTelegram: telegram, ChannelSMS: sms}
+	enqueueTest(t, user, "m1", "telegram,sms")
+
+	// получатель без чата в Telegram: попытка закрыта без повторов, SMS уходит новой попыткой
+	dispatch(t, transports)
+	if got := mustGet(t, "m1"); got.Status != SMSError || got.Channel != ChannelTelegram || got.Error == "" {
+		t.Fatalf("telegram attempt %+v", got)
+	}
+	dispatch(t, transports)
+	attempts, err := GetMessages("WHERE parent_uuid = 'm1'")
+	if err != nil || len(attempts) != 1 {
+		t.Fatalf("attempts %+v, %v", attempts, err)
+	}
+	if got := attempts[0]; got.Status != SMSProcessed || got.Channel != ChannelSMS || got.Device != "sim0" {
+		t.Errorf("sms attempt %+v", got)
+	}
+	if telegram.count() != 1 || sms.count() != 1 {
+		t.Errorf("telegram sent %d, sms %d; want one each", telegram.count(), sms.count())
+	}
+}
+
+func TestWorkerCancelQueued(t *testing.T) {
+	user := setupWorker(t)
+	sms := &fakeTransport{id: "sim0"}
+	enqueueTest(t, user, "m1", "sms")
+
+	// сообщение уже загружено в очередь, когда его отменяют
+	messages, err := getPendingMessages(10)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("loaded %v, %v", messages, err)
+	}
+	if ok, err := CancelMessage("m1"); !ok || err != nil {
+		t.Fatalf("CancelMessage = %v, %v", ok, err)
+	}
+	sendMessage(sms, messages[0])
+	if sms.count() != 0 {
+		t.Errorf("a cancelled message was sent")
+	}
+	if got := mustGet(t, "m1"); got.Status != SMSCancelled {
+		t.Errorf("after cancel %+v", got)
+	}
+	if ok, _ := CancelMessage("m1"); ok {
+		t.Errorf("cancelled twice")
+	}
+}
+
+func TestWorkerCancelWhileSending(t *testing.T) {
+	user := setupWorker(t)
+	var cancelled, edited bool
+	sms := &fakeTransport{id: "sim0", send: func(transport.Message) (transport.Result, error) {
+		cancelled, _ = CancelMessage("m1")
+		edited, _ = UpdatePendingMessage("m1", "changed", user)
+		return transport.Result{Status: transport.StatusSent}, nil
+	}}
+	enqueueTest(t, user, "m1", "sms")
+
+	dispatch(t, map[string]transport.Transport{ChannelSMS: sms})
+	if cancelled || edited {
+		t.Errorf("during send: cancelled %v, edited %v", cancelled, edited)
+	}
+	if got := mustGet(t, "m1"); got.Status != SMSProcessed || got.Body != "code 1234" {
+		t.Errorf("after send %+v", got)
+	}
+	if ok, _ := UpdatePendingMessage("m1", "changed", user); ok {
+		t.Errorf("a sent message was edited")
+	}
+}
+
+func TestWorkerEditQueued(t *testing.T) {
+	user := setupWorker(t)
+	sms := &fakeTransport{id: "sim0"}
+	enqueueTest(t, user, "m1", "sms")
+
+	messages, err := getPendingMessages(10)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("loaded %v, %v", messages, err)
+	}
+	other, err := InsertUser(&User{PhoneNumber: "+79007654321"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// в очереди старый текст, отправляется новый
+	if ok, err := UpdatePendingMessage("m1", "code 5678", other); !ok || err != nil {
+		t.Fatalf("UpdatePendingMessage = %v, %v", ok, err)
+	}
+	sendMessage(sms, messages[0])
+	if sms.count() != 1 || sms.sent[0].Body != "code 5678" || sms.sent[0].To != other.PhoneNumber {
+		t.Errorf("transport got %+v", sms.sent)
+	}
+}
+
+func TestWorkerScheduled(t *testing.T) {
+	user := setupWorker(t)
+	sms := &fakeTransport{id: "sim0"}
+	sendAt := time.Now().UTC().Add(time.Hour).Format(timeFormat)
+	if err := insertMessage(&SMS{UUID: "m1", Body: "later", User: user, Route: "sms", Channel: ChannelSMS, SendAt: sendAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := dispatch(t, map[string]transport.Transport{ChannelSMS: sms}); n != 0 {
+		t.Errorf("loaded %d messages before send_at", n)
+	}
+	if next, ok := getNextSendAt(); !ok || next.Format(timeFormat) != sendAt {
+		t.Errorf("getNextSendAt = %v, %v; want %s", next, ok, sendAt)
+	}
+}
+
+func TestWorkerQuietHours(t *testing.T) {
+	user := setupWorker(t)
+	sms := &fakeTransport{id: "sim0"}
+	quiet := Quiet
+	// тихие часы с текущего часа на два часа вперед в часовом поясе получателя
+	hour := time.Duration(time.Now().UTC().Hour()) * time.Hour
+	Quiet = QuietHours{Start: hour, End: (hour + 2*time.Hour) % (24 * time.Hour)}
+	t.Cleanup(func() { Quiet = quiet })
+	if err := UpdateTimezoneByPhoneNumber(user.PhoneNumber, "UTC"); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertMessage(&SMS{UUID: "m1", Body: "sale", User: user, Route: "sms", Channel: ChannelSMS, Marketing: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatch(t, map[string]transport.Transport{ChannelSMS: sms})
+	if sms.count() != 0 {
+		t.Fatalf("sent during quiet hours")
+	}
+	got := mustGet(t, "m1")
+	if got.Status != SMSPending || got.Retries != 0 || got.SendAt == "" {
+		t.Errorf("deferred %+v", got)
+	}
+	// отложенное сообщение можно отменить
+	if ok, _ := CancelMessage("m1"); !ok {
+		t.Errorf("a deferred message can't be cancelled")
+	}
+}
+
+// drain достает из очереди все сообщения в порядке отправки
+// startWorker запускает processMessages для каждого канала, как InitWorker, но без загрузчика:
+// сообщения в очередь кладет тест
+func startWorker(t *testing.T, transports map[string]transport.Transport) {
+	t.Helper()
+	stopping = make(chan struct{})
+	sendContext, abortSends = context.WithCancel(context.Background())
+	saved := supervisors
+	supervisors = nil
+	queues = make(map[string]*priorityQueue)
+	for channel := range transports {
+		queues[channel] = newPriorityQueue(10)
+	}
+	for channel, tr := range transports {
+		workers.Add(1)
+		go processMessages(tr, channel)
+	}
+	t.Cleanup(func() {
+		select {
+		case <-stopping:
+		default:
+			StopWorker(context.Background())
+		}
+		// как до InitWorker: очереди других тестов не останавливаются
+		stopping = nil
+		sendContext = context.Background()
+		supervisors = saved
+	})
+}
+
+// queueTest кладет ждущие сообщения из базы в очереди их каналов
+func queueTest(t *testing.T) {
+	t.Helper()
+	messages, err := getPendingMessages(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range messages {
+		queues[message.Channel].push(message)
+	}
+}
+
+// blockingSend отправка, которая ждет release и сообщает о начале в started
+func blockingSend(started chan<- string, release <-chan struct{}) func(transport.Message) (transport.Result, error) {
+	return func(msg transport.Message) (transport.Result, error) {
+		started <- msg.UUID
+		<-release
+		return transport.Result{Status: transport.StatusSent, Parts: []transport.Part{{Part: 1, Status: transport.StatusSent, Reference: 1}}}, nil
+	}
+}
+
+func TestStopWorkerDrains(t *testing.T) {
+	user := setupWorker(t)
+	started, release := make(chan string, 2), make(chan struct{})
+	sms := &fakeTransport{id: "sim0", send: blockingSend(started, release)}
+	startWorker(t, map[string]transport.Transport{ChannelSMS: sms})
+	enqueueTest(t, user, "m1", "sms")
+	enqueueTest(t, user, "m2", "sms")
+	queueTest(t)
+
+	first := <-started
+	stopped := make(chan error, 1)
+	go func() { stopped <- StopWorker(context.Background()) }()
+	select {
+	case err := <-stopped:
+		t.Fatalf("StopWorker returned %v before the send finished", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-stopped; err != nil {
+		t.Errorf("StopWorker = %v", err)
+	}
+
+	// текущее сообщение дошло до конца, следующее осталось ждать в базе
+	if sms.count() != 1 {
+		t.Errorf("sent %d messages, want 1", sms.count())
+	}
+	second := "m2"
+	if first == "m2" {
+		second = "m1"
+	}
+	if got := mustGet(t, first); got.Status != SMSProcessed {
+		t.Errorf("sent message %+v", got)
+	}
+	if got := mustGet(t, second); got.Status != SMSPending || got.Retries != 0 {
+		t.Errorf("queued message %+v", got)
+	}
+	// аренда снята, сообщение сразу возьмет следующий запуск
+	if lease := leaseOf(t, second); lease != "" {
+		t.Errorf("queued message still leased by %q", lease)
+	}
+}
+
+func TestStopWorkerTimeout(t *testing.T) {
+	user := setupWorker(t)
+	started := make(chan string, 1)
+	sms := &fakeTransport{id: "sim0"}
+	sms.send = func(msg transport.Message) (transport.Result, error) {
+		started <- msg.UUID
+		// модем, которому PDU уже передан, отвечает только на отмену
+		<-sendContext.Done()
+		return transport.Result{Status: transport.StatusUnknown}, context.Canceled
+	}
+	startWorker(t, map[string]transport.Transport{ChannelSMS: sms})
+	enqueueTest(t, user, "m1", "sms")
+	queueTest(t)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := StopWorker(ctx); err != context.DeadlineExceeded {
+		t.Errorf("StopWorker = %v, want deadline exceeded", err)
+	}
+	// прерванная отправка могла уйти, автоматически она не повторяется
+	if got := mustGet(t, "m1"); got.Status != SMSUnknown {
+		t.Errorf("aborted message %+v", got)
+	}
+}
+
+// leaseOf метка аренды сообщения в базе, пустая если аренды нет
+func leaseOf(t *testing.T, uuid string) string {
+	t.Helper()
+	var lease string
+	if err := db.QueryRow("SELECT COALESCE(locked_by, '') FROM messages WHERE uuid = ?", uuid).Scan(&lease); err != nil {
+		t.Fatal(err)
+	}
+	return lease
+}
+
+// expireLease переносит окончание аренды в прошлое, как будто ее владелец упал
+func expireLease(t *testing.T, uuid string) {
+	t.Helper()
+	if _, err := db.Exec("UPDATE messages SET lease_until = DATETIME('now', '-1 minute') WHERE uuid = ?", uuid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClaimMessage(t *testing.T) {
+	user := setupWorker(t)
+	enqueueTest(t, user, "m1", "sms")
+
+	first, err := getPendingMessages(10)
+	if err != nil || len(first) != 1 || first[0].lease == "" {
+		t.Fatalf("first loader got %+v, %v", first, err)
+	}
+	if leaseOf(t, "m1") != first[0].lease {
+		t.Errorf("locked_by %q, want %q", leaseOf(t, "m1"), first[0].lease)
+	}
+	// другой загрузчик не получит сообщение, пока аренда не истекла
+	if second, _ := getPendingMessages(10); len(second) != 0 {
+		t.Errorf("second loader got %+v", second)
+	}
+
+	expireLease(t, "m1")
+	second, err := getPendingMessages(10)
+	if err != nil || len(second) != 1 || second[0].lease == first[0].lease {
+		t.Fatalf("after expiry got %+v, %v", second, err)
+	}
+	// первый владелец потерял сообщение и не отправляет его
+	if renewLease(first[0], time.Minute) {
+		t.Errorf("stale lease renewed")
+	}
+	if !renewLease(second[0], time.Minute) {
+		t.Errorf("current lease not renewed")
+	}
+}
+
+func TestWorkerLeaseLost(t *testing.T) {
+	user := setupWorker(t)
+	sms := &fakeTransport{id: "sim0"}
+	transports := map[string]transport.Transport{ChannelSMS: sms}
+	enqueueTest(t, user, "m1", "sms")
+
+	stale, err := getPendingMessages(10)
+	if err != nil || len(stale) != 1 {
+		t.Fatalf("getPendingMessages = %+v, %v", stale, err)
+	}
+	expireLease(t, "m1")
+	// сообщение, которое пролежало в очереди дольше аренды, уже у другого загрузчика
+	if n := dispatch(t, transports); n != 1 {
+		t.Fatalf("dispatched %d, want 1", n)
+	}
+	sendMessage(sms, stale[0])
+	if sms.count() != 1 {
+		t.Errorf("sent %d times, want 1", sms.count())
+	}
+
+	// результат отправки со старой арендой не затирает сохраненный
+	late := stale[0]
+	late.Status = SMSError
+	late.Error = "late result"
+	updateMessageStatus(late)
+	if got := mustGet(t, "m1"); got.Status != SMSProcessed || got.Error != "" {
+		t.Errorf("after stale update %+v", got)
+	}
+	if lease := leaseOf(t, "m1"); lease != "" {
+		t.Errorf("sent message still leased by %q", lease)
+	}
+}
+
+func TestCancelAfterLeaseExpired(t *testing.T) {
+	user := setupWorker(t)
+	enqueueTest(t, user, "m1", "sms")
+	messages, err := getPendingMessages(10)
+	if err != nil || len(messages) != 1 || !renewLease(messages[0], time.Minute) {
+		t.Fatalf("claim and renew m1: %+v, %v", messages, err)
+	}
+	if ok, _ := CancelMessage("m1"); ok {
+		t.Errorf("cancelled while sending")
+	}
+	// экземпляр, который отправлял, упал: отметка об отправке истекла вместе с арендой
+	expireLease(t, "m1")
+	if ok, err := CancelMessage("m1"); !ok || err != nil {
+		t.Errorf("CancelMessage after lease expiry = %v, %v", ok, err)
+	}
+}
+
+func drain(q *priorityQueue) []string {
+	var order []string
+	for q.len() > 0 {
+		<-q.ready
+		order = append(order, q.pop().UUID)
+	}
+	return order
+}
+
+func TestPriorityQueueOrder(t *testing.T) {
+	q := newPriorityQueue(10)
+	q.push(SMS{UUID: "bulk", Priority: PriorityBulk})
+	q.push(SMS{UUID: "transactional", Priority: PriorityTransactional})
+	q.push(SMS{UUID: "unknown", Priority: 7})
+	q.push(SMS{UUID: "otp", Priority: PriorityOTP})
+
+	got := strings.Join(drain(q), ",")
+	if want := "otp,transactional,unknown,bulk"; got != want {
+		t.Errorf("order %s, want %s", got, want)
+	}
+}
+
+func TestPriorityQueueStarvation(t *testing.T) {
+	q := newPriorityQueue(3 * starvationLimit)
+	q.push(SMS{UUID: "bulk", Priority: PriorityBulk})
+	for i := 0; i < 2*starvationLimit; i++ {
+		q.push(SMS{UUID: fmt.Sprint("otp", i), Priority: PriorityOTP})
+	}
+
+	// рассылка пропускает starvationLimit более срочных и уходит вне очереди
+	order := drain(q)
+	if len(order) != 2*starvationLimit+1 || order[starvationLimit] != "bulk" {
+		t.Errorf("order %v, want bulk after %d otp", order, starvationLimit)
+	}
+}